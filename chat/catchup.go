@@ -0,0 +1,169 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// HistoryProtocol lets a peer who just joined a room fetch what it missed
+// from the members already there
+const HistoryProtocol = "/chat/history/1.0.0"
+
+const (
+	// CatchUpSize is the most messages we ask for, or hand out, at once
+	CatchUpSize = 100
+	// catchUpWait is how long a new room member waits for somebody to ask
+	catchUpWait = 30 * time.Second
+	// catchUpPeers is how many members we ask
+	catchUpPeers = 3
+	// catchUpPages is how many times we ask each of them for more
+	catchUpPages = HistoryKeep / CatchUpSize
+)
+
+// catchUpRequest asks for at most Limit records, those that came after
+// the one with ID After. Peers get messages in their own time and order:
+// the ID is something we agree on, the time we got it is not.
+type catchUpRequest struct {
+	After string `json:"after"`
+	Limit int    `json:"limit"`
+}
+
+func historyProtocol(roomName string) protocol.ID {
+	return protocol.ID(HistoryProtocol + "/" + roomName)
+}
+
+// handleCatchUp hands our recent history to a newcomer
+func (cr *ChatRoom) handleCatchUp(s network.Stream) {
+	defer s.Close()
+	if !cr.track() {
+		s.Reset()
+		return
+	}
+	defer cr.wg.Done()
+	s.SetDeadline(time.Now().Add(privateTimeout))
+
+	req := new(catchUpRequest)
+	if err := json.NewDecoder(io.LimitReader(s, 1024)).Decode(req); err != nil {
+		s.Reset()
+		return
+	}
+	if req.Limit <= 0 || req.Limit > CatchUpSize {
+		req.Limit = CatchUpSize
+	}
+	recs, err := cr.history.After(cr.roomName, req.After, req.Limit)
+	if err != nil {
+		s.Reset()
+		return
+	}
+	enc := json.NewEncoder(s)
+	for _, rec := range recs {
+		if err := enc.Encode(rec); err != nil {
+			s.Reset()
+			return
+		}
+	}
+}
+
+// catchUp waits for the room to have members, then asks a few of them for
+// what was said before we came. Messages we did not have yet are stored and
+// delivered like any other, oldest first.
+func (cr *ChatRoom) catchUp() {
+	var after string
+	if recs, err := cr.history.Last(cr.roomName, 1); err == nil && len(recs) == 1 {
+		after = recs[0].ID
+	}
+
+	deadline := time.After(catchUpWait)
+	var members []peer.ID
+	for len(members) == 0 {
+		select {
+		case <-time.After(500 * time.Millisecond):
+			members = cr.ListPeers()
+		case <-deadline:
+			return // nobody to ask
+		case <-cr.ctx.Done():
+			return
+		}
+	}
+	if len(members) > catchUpPeers {
+		members = members[:catchUpPeers]
+	}
+
+	got := 0
+	for _, p := range members {
+		// a page at a time, for as long as p has more
+		for page, from := 0, after; page < catchUpPages; page++ {
+			n, last, err := cr.catchUpFrom(p, from)
+			got += n
+			if err != nil {
+				cr.emit(&Event{Type: EventError, Peer: p, Text: "catch up", Err: err})
+				break
+			}
+			if last == "" || last == from {
+				break
+			}
+			from = last
+		}
+	}
+	cr.emit(&Event{Type: EventCaughtUp, Text: fmt.Sprintf("%d earlier messages", got)})
+}
+
+// catchUpFrom fetches a page of history from p, those after the record with
+// ID after. It returns how many messages were new to us, and the ID of the
+// page's last record if the page was full, to ask for the next one.
+func (cr *ChatRoom) catchUpFrom(p peer.ID, after string) (int, string, error) {
+	ctx, cancel := context.WithTimeout(cr.ctx, privateTimeout)
+	defer cancel()
+	s, err := cr.h.NewStream(network.WithUseTransient(ctx, "catch up"), p, historyProtocol(cr.roomName))
+	if err != nil {
+		return 0, "", err
+	}
+	defer s.Close()
+	s.SetDeadline(time.Now().Add(privateTimeout))
+
+	if err := json.NewEncoder(s).Encode(catchUpRequest{After: after, Limit: CatchUpSize}); err != nil {
+		s.Reset()
+		return 0, "", err
+	}
+	s.CloseWrite()
+
+	n, last := 0, ""
+	dec := json.NewDecoder(io.LimitReader(s, CatchUpSize*maxPrivateSize))
+	for i := 0; i < CatchUpSize; i++ {
+		rec := new(Record)
+		if err := dec.Decode(rec); err == io.EOF {
+			return n, "", nil
+		} else if err != nil {
+			return n, "", err
+		}
+		// p passes on other people's messages: they have to prove themselves
+		if err := openRecord(rec); err != nil {
+			cr.emit(&Event{Type: EventRejected, Peer: p, Err: err})
+			continue
+		}
+		last = rec.ID
+		if rec.Message.To != "" || isCommand(rec.Message) || rec.Message.Message == "" {
+			continue // never part of history
+		}
+		added, err := cr.history.Add(cr.roomName, rec)
+		if err != nil {
+			return n, "", err
+		}
+		if !added {
+			continue
+		}
+		n++
+		rec.Message.Room = cr.roomName
+		if !cr.deliver(rec.Message) {
+			return n, "", nil
+		}
+	}
+	return n, last, nil
+}
@@ -0,0 +1,524 @@
+// Package chat is a pubsub chat room that can be embedded in other programs.
+// A ChatRoom knows nothing about consoles: received messages arrive on its
+// Messages and Data channels, everything else that happens in the room
+// arrives on Events.
+package chat
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/discovery"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+)
+
+// ChatRoomBufSize is the number of incoming messages to buffer for each topic.
+const ChatRoomBufSize = 128
+
+// ChatRoom represents a subscription to a single PubSub topic. Messages
+// can be published to the topic with ChatRoom.Publish, and received
+// messages are pushed to the Messages channel.
+type ChatRoom struct {
+	// Messages is a channel of messages received from other peers in the chat room
+	Messages chan *ChatMessage
+	// Data is a channel for binary carried as payload
+	Data chan *ChatData
+	// Events reports what goes on in the room, apart from messages
+	Events chan *Event
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	mu     sync.Mutex // guards closed, so nothing joins wg once Close waits, and nick
+	closed bool
+	done   chan struct{}
+
+	h     host.Host
+	ps    *pubsub.PubSub
+	topic *pubsub.Topic
+	sub   *pubsub.Subscription
+	disc  discovery.Discovery
+
+	roomName string
+	self     peer.ID
+	nick     string
+	commands CommandHandler
+	history  *History
+	limits   Limits
+	limiter  *rateLimiter
+	replies  *rateLimiter // see reply
+	nicks    *Directory
+
+	heartbeat time.Duration
+	events    *pubsub.TopicEventHandler
+	presMu    sync.Mutex
+	roster    map[peer.ID]*Presence // who else is here
+	status    string
+	beatDue   bool // a heartbeat for newcomers is on its way
+
+	callMu sync.Mutex
+	calls  map[string]*pending // calls waiting for replies, by ID
+
+	downloads   string // where accepted files go, see WithDownloads
+	maxDownload int64  // see WithMaxDownload
+	offerMu     sync.Mutex
+	offers      map[string]*Offer // files waiting for Accept, by ID
+
+	stats roomStats
+	mesh  *Mesh // see WithMesh
+}
+
+// ChatMessage gets converted to/from JSON and sent, in an Envelope, in the body
+// of pubsub messages. SenderID of a received message has been checked
+// against the pubsub signature.
+type ChatMessage struct {
+	Message    string
+	To         string
+	Payload    []byte
+	SenderID   string
+	SenderNick string
+
+	// Call and Reply tie a command to its answer, see ChatRoom.Call; Error
+	// is how a command failed
+	Call  string `json:",omitempty"`
+	Reply string `json:",omitempty"`
+	Error string `json:",omitempty"`
+	// Status is the sender's status text, see ChatRoom.SetStatus
+	Status string `json:",omitempty"`
+	// Leaving says the sender is on its way out
+	Leaving bool `json:",omitempty"`
+
+	// Room we got the message in, and its (hex) pubsub ID: these are not sent
+	Room string `json:"-"`
+	ID   string `json:"-"`
+}
+
+// ChatData is the payload of a message, passed on separately. A file we
+// accepted comes this way too, as the path it was saved at in File.
+type ChatData struct {
+	Data       []byte
+	File       string
+	SenderID   string
+	SenderNick string
+	Room       string
+}
+
+// From is how the sender of the data is shown, see ChatMessage.From
+func (data *ChatData) From() string {
+	cm := ChatMessage{SenderID: data.SenderID, SenderNick: data.SenderNick}
+	return cm.From()
+}
+
+// CommandHandler runs a command (a message starting with '/') sent to us by
+// another peer. The reply, with its optional payload, goes back to the sender;
+// an empty reply without payload is not sent. Registry.Handler makes one.
+type CommandHandler func(cm *ChatMessage) (reply string, payload []byte, err error)
+
+var (
+	errNoHost = errors.New("chat: a host is required, use WithHost")
+	errClosed = errors.New("chat: room closed")
+)
+
+// JoinChatRoom tries to subscribe to the PubSub topic for the room name, returning
+// a ChatRoom on success. The room lives until ctx is done or Close is called.
+func JoinChatRoom(ctx context.Context, opts ...Option) (*ChatRoom, error) {
+	cr := &ChatRoom{
+		Messages:    make(chan *ChatMessage, ChatRoomBufSize),
+		Data:        make(chan *ChatData, ChatRoomBufSize),
+		Events:      make(chan *Event, ChatRoomBufSize),
+		roomName:    DefaultRoom,
+		limits:      DefaultLimits,
+		done:        make(chan struct{}),
+		calls:       make(map[string]*pending),
+		offers:      make(map[string]*Offer),
+		maxDownload: DefaultMaxDownload,
+		nicks:       NewDirectory(),
+		roster:      make(map[peer.ID]*Presence),
+		heartbeat:   DefaultHeartbeat,
+	}
+	for _, opt := range opts {
+		if err := opt(cr); err != nil {
+			return nil, err
+		}
+	}
+	if cr.h == nil {
+		return nil, errNoHost
+	}
+	cr.self = cr.h.ID()
+	if cr.nick == "" {
+		cr.nick = DefaultNick(cr.self)
+	}
+	cr.nicks.Set(cr.self, cr.nick)
+
+	cr.limiter = newRateLimiter(cr.limits)
+	cr.replies = newRateLimiter(replyLimits)
+
+	var err error
+	if cr.ps == nil {
+		// subscription is the 1st thing: done by the host
+		cr.ps, err = NewGossipSub(ctx, cr.h)
+		if err != nil {
+			return nil, err
+		}
+	}
+	cr.ctx, cr.cancel = context.WithCancel(ctx)
+
+	// nothing gets into the room, or through it, without passing validate
+	if err := cr.ps.RegisterTopicValidator(topicName(cr.roomName), cr.validate); err != nil {
+		cr.cancel()
+		return nil, err
+	}
+
+	// join the pubsub topic
+	cr.topic, err = cr.ps.Join(topicName(cr.roomName))
+	if err != nil {
+		cr.ps.UnregisterTopicValidator(topicName(cr.roomName))
+		cr.cancel()
+		return nil, err
+	}
+	// rejected messages count against their deliverers, if the pubsub
+	// keeps scores (see NewGossipSub)
+	cr.topic.SetScoreParams(topicScoreParams())
+
+	// and subscribe to it
+	cr.sub, err = cr.topic.Subscribe()
+	if err != nil {
+		cr.topic.Close()
+		cr.ps.UnregisterTopicValidator(topicName(cr.roomName))
+		cr.cancel()
+		return nil, err
+	}
+
+	// and keep an eye on who comes and goes
+	cr.events, err = cr.topic.EventHandler()
+	if err != nil {
+		cr.sub.Cancel()
+		cr.topic.Close()
+		cr.ps.UnregisterTopicValidator(topicName(cr.roomName))
+		cr.cancel()
+		return nil, err
+	}
+	cr.wg.Add(1)
+	go func() {
+		defer cr.wg.Done()
+		cr.peerEvents(cr.events)
+	}()
+	if cr.heartbeat > 0 {
+		cr.wg.Add(1)
+		go func() {
+			defer cr.wg.Done()
+			cr.presenceLoop()
+		}()
+	}
+
+	// use DHT, if we were given one
+	if cr.disc != nil {
+		cr.wg.Add(1)
+		go func() {
+			defer cr.wg.Done()
+			cr.discoverPeers()
+		}()
+	}
+
+	// start reading messages from the subscription in a loop
+	cr.wg.Add(1)
+	go func() {
+		defer cr.wg.Done()
+		cr.readLoop()
+	}()
+
+	// and take private messages directly
+	cr.h.SetStreamHandler(privateProtocol(cr.roomName), cr.handlePrivate)
+	cr.h.SetStreamHandler(transferProtocol(cr.roomName), cr.handleTransfer)
+
+	// share what we remember, and find out what we missed
+	if cr.history != nil {
+		cr.h.SetStreamHandler(historyProtocol(cr.roomName), cr.handleCatchUp)
+		cr.wg.Add(1)
+		go func() {
+			defer cr.wg.Done()
+			cr.catchUp()
+		}()
+	}
+
+	// nobody sends anything once the loops are done
+	go func() {
+		<-cr.ctx.Done()
+		cr.mu.Lock()
+		cr.closed = true
+		cr.mu.Unlock()
+		cr.wg.Wait()
+		close(cr.Messages)
+		close(cr.Data)
+		close(cr.Events)
+		close(cr.done)
+	}()
+
+	return cr, nil
+}
+
+// Publish sends a message to the pubsub topic. A message for a single peer
+// (`to` being its nickname or short ID, see FindPeer) goes to that peer alone.
+func (cr *ChatRoom) Publish(message string, to string, payload []byte) error {
+	m := ChatMessage{
+		Message:    message,
+		To:         to,
+		Payload:    payload,
+		SenderID:   cr.self.Pretty(),
+		SenderNick: cr.Nick(),
+		Status:     cr.Status(),
+	}
+
+	if to != "" {
+		return cr.sendPrivate(to, &m)
+	}
+
+	msgBytes, err := encodeMessage(&m)
+	if err != nil {
+		return err
+	}
+	cr.stats.out.Add(1)
+	return cr.topic.Publish(cr.ctx, msgBytes)
+}
+
+// ListPeers returns the peers we share this room's topic with
+func (cr *ChatRoom) ListPeers() []peer.ID {
+	return cr.ps.ListPeers(topicName(cr.roomName))
+}
+
+// Room is the name of the room, without the topic prefix
+func (cr *ChatRoom) Room() string {
+	return cr.roomName
+}
+
+// Nick is the nickname we use in this room
+func (cr *ChatRoom) Nick() string {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	return cr.nick
+}
+
+// Self is our own peer ID
+func (cr *ChatRoom) Self() peer.ID {
+	return cr.self
+}
+
+// Close leaves the room: we say goodbye, the subscription is cancelled, the
+// topic released, and discovery for the room stops (advertising with it).
+// Messages is closed once the reader is done.
+func (cr *ChatRoom) Close() error {
+	cr.bye()
+	cr.h.RemoveStreamHandler(privateProtocol(cr.roomName))
+	cr.h.RemoveStreamHandler(transferProtocol(cr.roomName))
+	if cr.history != nil {
+		cr.h.RemoveStreamHandler(historyProtocol(cr.roomName))
+	}
+	cr.ps.UnregisterTopicValidator(topicName(cr.roomName))
+	cr.cancel()
+	cr.sub.Cancel()
+	cr.events.Cancel()
+	<-cr.done
+	return cr.topic.Close()
+}
+
+// track counts a goroutine in wg, unless the room is closing
+func (cr *ChatRoom) track() bool {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	if cr.closed {
+		return false
+	}
+	cr.wg.Add(1)
+	return true
+}
+
+// withRoom is ctx, done as well when the room closes
+func (cr *ChatRoom) withRoom(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-cr.ctx.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// readLoop pulls messages from the pubsub topic and pushes them onto the Messages channel.
+func (cr *ChatRoom) readLoop() {
+	for {
+		msg, err := cr.sub.Next(cr.ctx)
+		if err != nil {
+			return
+		}
+		mine := msg.ReceivedFrom == cr.self
+
+		// validate has seen to it
+		cm, ok := msg.ValidatorData.(*ChatMessage)
+		if !ok {
+			continue
+		}
+		// what we said goes in the history too
+		if !cr.remember(msg, cm) || mine {
+			continue // we have seen it before, or said it
+		}
+		if !cr.handle(cm) {
+			return
+		}
+	}
+}
+
+// remember puts a public message in the history, false if it was there already
+func (cr *ChatRoom) remember(msg *pubsub.Message, cm *ChatMessage) bool {
+	rec, err := newRecord(msg, cm)
+	if err != nil {
+		return true
+	}
+	cm.ID = rec.ID
+	if cr.history == nil || isCommand(cm) || cm.Message == "" {
+		return true
+	}
+	added, err := cr.history.Add(cr.roomName, rec)
+	if err != nil {
+		cr.emit(&Event{Type: EventError, Text: "history", Err: err})
+		return true
+	}
+	return added
+}
+
+// isCommand tells commands from things people say
+func isCommand(cm *ChatMessage) bool {
+	return strings.HasPrefix(cm.Message, "/")
+}
+
+// handle runs commands and passes everything else on, false once the room is closing
+func (cr *ChatRoom) handle(cm *ChatMessage) bool {
+	cm.Room = cr.roomName
+	cr.stats.in.Add(1)
+	cr.noteNick(cm)
+	if cm.Leaving {
+		cr.gone(senderID(cm))
+		return true
+	}
+	cr.seen(cm)
+	// an answer to one of our calls goes to the caller alone
+	if cm.Reply != "" {
+		cr.answer(cm)
+		return true
+	}
+	// an empty message says who we are, and nothing else
+	if cm.Message == "" && len(cm.Payload) == 0 {
+		return true
+	}
+	// is this a remote command?
+	if isCommand(cm) {
+		cr.runCommand(cm)
+		return true
+	}
+	// send the payloaded messages to data channel
+	if cm.Payload != nil && string(cm.Payload) != "" {
+		data := new(ChatData)
+		data.Data = cm.Payload
+		data.SenderID = cm.SenderID
+		data.SenderNick = cm.SenderNick
+		data.Room = cm.Room
+		// send both
+		return cr.deliver(cm) && cr.deliverData(data)
+	}
+	// send valid messages onto the Messages channel
+	return cr.deliver(cm)
+}
+
+// runCommand hands a remote command to the CommandHandler, replying to the sender.
+// A Call always gets a reply, if only to say it failed.
+func (cr *ChatRoom) runCommand(cm *ChatMessage) {
+	if cr.commands == nil {
+		if cm.Call != "" {
+			cr.reply(cm, &ChatMessage{Error: "no commands here"})
+		}
+		return // we don't take commands
+	}
+	reply, p, err := cr.commands(cm)
+	if err != nil {
+		cr.emit(&Event{Type: EventError, Peer: senderID(cm), Text: cm.Message, Err: err})
+		if cm.Call != "" {
+			cr.reply(cm, &ChatMessage{Error: err.Error()})
+		}
+		return
+	}
+	if reply == "" && len(p) == 0 && cm.Call == "" {
+		return // nothing to say
+	}
+	// new message back to sender
+	cr.reply(cm, &ChatMessage{Message: reply, Payload: p})
+}
+
+// replyLimits bound how often we answer any one peer's commands
+var replyLimits = Limits{MaxSize: 1, Rate: 1, Burst: 5}
+
+// reply sends m back to whoever sent cm. It goes in the background: the
+// sender may be slow to reach, and the room's reader does not wait for it.
+func (cr *ChatRoom) reply(cm *ChatMessage, m *ChatMessage) {
+	p := senderID(cm)
+	if !cr.replies.allow(p, time.Now()) {
+		return // asking too often, no answer
+	}
+	m.To = cm.Sender()
+	m.Reply = cm.Call
+	m.SenderID = cr.self.Pretty()
+	m.SenderNick = cr.Nick()
+	if !cr.track() {
+		return
+	}
+	go func() {
+		defer cr.wg.Done()
+		if err := cr.sendWithin(p, m, replyTimeout); err != nil {
+			cr.emit(&Event{Type: EventError, Peer: p, Text: "reply", Err: err})
+		}
+	}()
+}
+
+func (cr *ChatRoom) deliver(cm *ChatMessage) bool {
+	select {
+	case cr.Messages <- cm:
+		return true
+	case <-cr.ctx.Done():
+		return false
+	}
+}
+
+func (cr *ChatRoom) deliverData(data *ChatData) bool {
+	select {
+	case cr.Data <- data:
+		return true
+	case <-cr.ctx.Done():
+		return false
+	}
+}
+
+// prefix the chatroom name (why?)
+func topicName(roomName string) string {
+	return "chat-room:" + roomName
+}
+
+// Sender returns the short form of the senderID
+func (cm *ChatMessage) Sender() (sender string) {
+	sender = cm.SenderID
+	if len(sender) > 8 {
+		sender = sender[len(sender)-8:]
+	}
+	return
+}
+
+// senderID decodes SenderID, an empty ID if it won't
+func senderID(cm *ChatMessage) peer.ID {
+	id, _ := peer.Decode(cm.SenderID)
+	return id
+}
@@ -0,0 +1,270 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+)
+
+// loopbackHost is a host nobody outside this machine can reach
+func loopbackHost(t *testing.T) host.Host {
+	t.Helper()
+	h, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { h.Close() })
+	return h
+}
+
+// joinPair puts two loopback hosts in the same room, with no bootstrap at all
+func joinPair(t *testing.T, ctx context.Context, room string) (*ChatRoom, *ChatRoom) {
+	t.Helper()
+	ha, hb := loopbackHost(t), loopbackHost(t)
+	if n := Connect(ctx, ha, []peer.AddrInfo{{ID: hb.ID(), Addrs: hb.Addrs()}}); n != 1 {
+		t.Fatalf("connected to %d peers, wanted 1", n)
+	}
+	a, err := JoinChatRoom(ctx, WithHost(ha), WithNick("alice"), WithRoom(room))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := JoinChatRoom(ctx, WithHost(hb), WithNick("bob"), WithRoom(room))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { a.Close(); b.Close() })
+
+	// wait for the subscriptions to meet
+	for len(a.ListPeers()) == 0 || len(b.ListPeers()) == 0 {
+		select {
+		case <-ctx.Done():
+			t.Fatal("peers never saw each other in the room")
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	return a, b
+}
+
+// resend keeps calling send until ctx is done: a fresh subscription can
+// be listed by ListPeers a moment before gossipsub will carry anything to it
+func resend(t *testing.T, ctx context.Context, send func() error) {
+	t.Helper()
+	if err := send(); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		ticker := time.NewTicker(250 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				send()
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+func TestOfflineRoom(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	a, b := joinPair(t, ctx, "offline")
+
+	resend(t, ctx, func() error { return a.Publish("hello\n", "", nil) })
+	select {
+	case cm := <-b.Messages:
+		if cm.Message != "hello\n" || cm.SenderNick != "alice" {
+			t.Errorf("got %q from %q, wanted %q from %q", cm.Message, cm.SenderNick, "hello\n", "alice")
+		}
+	case <-ctx.Done():
+		t.Fatal("message never arrived")
+	}
+}
+
+func TestParseBootstrap(t *testing.T) {
+	var tests = []struct {
+		s   string
+		n   int
+		err bool
+	}{
+		{"none", 0, false},
+		{"", 0, false},
+		{"default", len(DefaultBootstrapPeers()), false},
+		{"/ip4/127.0.0.1/tcp/4001/p2p/QmcZf59bWwK5XFi76CZX8cbJ4BhTzzA3gU1ZjYZcYW3dwt", 1, false},
+		{"/ip4/127.0.0.1/tcp/4001", 0, true},
+	}
+	for _, test := range tests {
+		infos, err := ParseBootstrap(test.s)
+		if (err != nil) != test.err {
+			t.Errorf("ParseBootstrap(%q) error = %v, wanted error: %v", test.s, err, test.err)
+		}
+		if len(infos) != test.n {
+			t.Errorf("ParseBootstrap(%q) = %d peers, wanted %d", test.s, len(infos), test.n)
+		}
+	}
+}
+
+func TestImpersonation(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	a, b := joinPair(t, ctx, "forged")
+
+	// a claims to be b, and has dropped its own checks to do so
+	a.ps.UnregisterTopicValidator(topicName("forged"))
+	forged, err := encodeMessage(&ChatMessage{Message: "/iam\n", SenderID: b.self.Pretty(), SenderNick: "bob"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resend(t, ctx, func() error { return a.topic.Publish(ctx, forged) })
+	for {
+		select {
+		case ev := <-b.Events:
+			if ev.Type != EventRejected {
+				continue
+			}
+			if ev.Err != ErrImpersonation || ev.Peer != a.self {
+				t.Errorf("rejected %v from %v, wanted %v from %v", ev.Err, ev.Peer, ErrImpersonation, a.self)
+			}
+			return
+		case cm := <-b.Messages:
+			t.Fatalf("forged message got through: %+v", cm)
+		case <-ctx.Done():
+			t.Fatal("forged message was never rejected")
+		}
+	}
+}
+
+func TestPrivate(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	a, b := joinPair(t, ctx, "private")
+
+	if err := a.Publish("psst\n", ShortID(b.self), nil); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case cm := <-b.Messages:
+		if cm.Message != "psst\n" || cm.To == "" || cm.SenderID != a.self.Pretty() {
+			t.Errorf("got %+v, wanted a private %q from %s", cm, "psst\n", a.self)
+		}
+	case <-ctx.Done():
+		t.Fatal("private message never arrived")
+	}
+
+	if err := a.Publish("hello?\n", "nobody12", nil); err == nil {
+		t.Error("sent a private message to nobody")
+	}
+}
+
+func TestLimits(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	a, b := joinPair(t, ctx, "limits")
+
+	// our own validator turns it down first
+	if err := a.Publish(string(make([]byte, DefaultLimits.MaxSize)), "", nil); err == nil {
+		t.Error("published an oversize message")
+	}
+
+	// b lets DefaultLimits.Burst through, then starts rejecting
+	a.ps.UnregisterTopicValidator(topicName("limits"))
+	resend(t, ctx, func() error {
+		for i := 0; i < 2*DefaultLimits.Burst; i++ {
+			if err := a.Publish("flood\n", "", nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	for {
+		select {
+		case ev := <-b.Events:
+			if ev.Type == EventRejected && errors.Is(ev.Err, errTooFast) {
+				return
+			}
+		case <-ctx.Done():
+			t.Fatal("flood was never rate limited")
+		}
+	}
+}
+
+func TestPrivateLimits(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	a, b := joinPair(t, ctx, "private-limits")
+	rejected := func(want error) {
+		t.Helper()
+		for {
+			select {
+			case ev := <-b.Events:
+				if ev.Type == EventRejected && errors.Is(ev.Err, want) {
+					return
+				}
+			case <-ctx.Done():
+				t.Fatalf("no rejection for %v", want)
+			}
+		}
+	}
+
+	// too big for the topic is too big here too
+	a.Publish(string(make([]byte, DefaultLimits.MaxSize)), ShortID(b.self), nil)
+	rejected(errTooBig)
+
+	// and a's bucket empties all the same
+	for i := 0; i < DefaultLimits.Burst; i++ {
+		a.Publish("psst\n", ShortID(b.self), nil)
+	}
+	rejected(errTooFast)
+}
+
+func TestRateLimiter(t *testing.T) {
+	rl := newRateLimiter(Limits{MaxSize: 1, Rate: 1, Burst: 2})
+	now := time.Now()
+	var tests = []struct {
+		after time.Duration
+		allow bool
+	}{
+		{0, true},
+		{0, true},
+		{0, false},                      // burst used up
+		{500 * time.Millisecond, false}, // half a token
+		{500 * time.Millisecond, true},  // a whole one
+		{10 * time.Second, true},        // full again, but no more than burst
+		{0, true},
+		{0, false},
+	}
+	for i, test := range tests {
+		now = now.Add(test.after)
+		if got := rl.allow("p", now); got != test.allow {
+			t.Errorf("step %d: allow = %v, wanted %v", i, got, test.allow)
+		}
+	}
+}
+
+func TestVerdict(t *testing.T) {
+	var tests = []struct {
+		err       error
+		forwarded bool
+		want      pubsub.ValidationResult
+	}{
+		{nil, false, pubsub.ValidationAccept},
+		{errTooFast, false, pubsub.ValidationReject}, // the flooder itself
+		{errTooFast, true, pubsub.ValidationIgnore},  // the relaying peer may be innocent
+		{errTooBig, true, pubsub.ValidationReject},
+		{errPublicTo, false, pubsub.ValidationReject},
+		{errors.New("chat: bad signature"), true, pubsub.ValidationReject},
+	}
+	for _, test := range tests {
+		if got := verdict(test.err, test.forwarded); got != test.want {
+			t.Errorf("verdict(%v, %v) = %v, wanted %v", test.err, test.forwarded, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package chat
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Where says who may run a command: we at our console, other peers, or both
+type Where int
+
+const (
+	// Local commands are typed at our own console
+	Local Where = 1 << iota
+	// Remote commands are sent to us by other peers
+	Remote
+	// Both local and remote
+	Both = Local | Remote
+)
+
+func (w Where) String() string {
+	switch w {
+	case Local:
+		return "local"
+	case Remote:
+		return "remote"
+	case Both:
+		return "both"
+	}
+	return fmt.Sprintf("where(%d)", int(w))
+}
+
+var (
+	// ErrUnknownCommand is returned for a command nobody registered
+	ErrUnknownCommand = errors.New("unknown command")
+	// ErrNotHere is returned for a command that may not run the way it was asked to
+	ErrNotHere = errors.New("command not available")
+)
+
+// Call is one use of a command
+type Call struct {
+	Name   string       // the command's name, even if an alias was used
+	Args   string       // everything after the name, trimmed
+	Remote bool         // sent by another peer
+	From   *ChatMessage // the message a remote call came in
+}
+
+// Result is what a command wants published: Message (to `To`, or to the
+// room) with an optional Payload, and Output, shown to whoever ran it and
+// never published. A command with nothing to say returns nil.
+type Result struct {
+	Message string
+	To      string
+	Payload []byte
+	Output  string
+}
+
+// CommandFunc runs a command
+type CommandFunc func(c *Call) (*Result, error)
+
+// Command is a command that can be typed as /name (or /alias) followed by Args
+type Command struct {
+	Name    string   // with the leading '/'
+	Aliases []string // likewise
+	Args    string   // syntax of the arguments, for help
+	Help    string   // one line
+	Where   Where
+	Run     CommandFunc
+}
+
+// Usage is the command as it is typed
+func (cmd *Command) Usage() string {
+	if cmd.Args == "" {
+		return cmd.Name
+	}
+	return cmd.Name + " " + cmd.Args
+}
+
+// Registry holds the commands we know, it is safe for concurrent use.
+// Validation, dispatch and help all come from it.
+type Registry struct {
+	mu     sync.RWMutex
+	byName map[string]*Command
+	cmds   []*Command
+	policy *Policy
+}
+
+// NewRegistry returns a Registry with the commands given
+func NewRegistry(cmds ...*Command) (*Registry, error) {
+	r := &Registry{byName: make(map[string]*Command)}
+	for _, cmd := range cmds {
+		if err := r.Register(cmd); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// Register adds cmd. Its name and aliases must not be taken.
+func (r *Registry) Register(cmd *Command) error {
+	names := append([]string{cmd.Name}, cmd.Aliases...)
+	for _, name := range names {
+		if !strings.HasPrefix(name, "/") || strings.ContainsAny(name, " \t\n") {
+			return fmt.Errorf("bad command name %q", name)
+		}
+	}
+	if cmd.Run == nil || cmd.Where&Both == 0 {
+		return fmt.Errorf("command %s: needs Run and Where", cmd.Name)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, name := range names {
+		if _, ok := r.byName[name]; ok {
+			return fmt.Errorf("command %s already registered", name)
+		}
+	}
+	for _, name := range names {
+		r.byName[name] = cmd
+	}
+	r.cmds = append(r.cmds, cmd)
+	sort.Slice(r.cmds, func(i, j int) bool { return r.cmds[i].Name < r.cmds[j].Name })
+	return nil
+}
+
+// SetPolicy has p decide which peers may run which remote commands.
+// Without a Policy, no remote command runs at all.
+func (r *Registry) SetPolicy(p *Policy) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.policy = p
+}
+
+// Lookup finds a command by name or alias
+func (r *Registry) Lookup(name string) (*Command, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	cmd, ok := r.byName[name]
+	return cmd, ok
+}
+
+// Commands lists the commands, sorted by name
+func (r *Registry) Commands() []*Command {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return append([]*Command{}, r.cmds...)
+}
+
+// Parse splits a line like "/name args\n" into the command and its arguments
+func (r *Registry) Parse(line string) (*Command, string, bool) {
+	name, args, _ := strings.Cut(strings.TrimSpace(line), " ")
+	cmd, ok := r.Lookup(name)
+	return cmd, strings.TrimSpace(args), ok
+}
+
+// Valid says whether line is a command we can run, locally or for a remote peer
+func (r *Registry) Valid(line string, remote bool) bool {
+	cmd, _, ok := r.Parse(line)
+	return ok && cmd.Where&where(remote) != 0
+}
+
+func where(remote bool) Where {
+	if remote {
+		return Remote
+	}
+	return Local
+}
+
+// Run runs the command on line. from is the message a remote call came
+// in, nil for a local one: remote calls must pass the Policy too.
+func (r *Registry) Run(line string, from *ChatMessage) (*Result, error) {
+	cmd, args, ok := r.Parse(line)
+	if !ok {
+		name, _, _ := strings.Cut(strings.TrimSpace(line), " ")
+		return nil, fmt.Errorf("%w: %q", ErrUnknownCommand, name)
+	}
+	remote := from != nil
+	if cmd.Where&where(remote) == 0 {
+		return nil, fmt.Errorf("%w: %s is %s only", ErrNotHere, cmd.Name, cmd.Where)
+	}
+	if remote {
+		r.mu.RLock()
+		policy := r.policy
+		r.mu.RUnlock()
+		if policy == nil {
+			return nil, fmt.Errorf("%w: no remote commands here", ErrDenied)
+		}
+		if err := policy.Check(cmd.Name, line, senderID(from)); err != nil {
+			return nil, err
+		}
+	}
+	return cmd.Run(&Call{Name: cmd.Name, Args: args, Remote: remote, From: from})
+}
+
+// Handler runs the remote commands of a room, see WithCommands
+func (r *Registry) Handler() CommandHandler {
+	return func(cm *ChatMessage) (string, []byte, error) {
+		res, err := r.Run(cm.Message, cm)
+		if err != nil || res == nil {
+			return "", nil, err
+		}
+		return res.Message, res.Payload, nil
+	}
+}
+
+// Help lists the commands, one line each
+func (r *Registry) Help() string {
+	var b strings.Builder
+	for _, cmd := range r.Commands() {
+		fmt.Fprintf(&b, "%-22s %s", cmd.Usage(), cmd.Help)
+		if len(cmd.Aliases) > 0 {
+			fmt.Fprintf(&b, " (also %s)", strings.Join(cmd.Aliases, ", "))
+		}
+		if cmd.Where != Local {
+			fmt.Fprintf(&b, " [%s]", cmd.Where)
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
@@ -0,0 +1,68 @@
+package chat
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+const testPeer = "QmcZf59bWwK5XFi76CZX8cbJ4BhTzzA3gU1ZjYZcYW3dwt"
+
+func TestRegistry(t *testing.T) {
+	echo := func(c *Call) (*Result, error) {
+		return &Result{Message: c.Name + ":" + c.Args}, nil
+	}
+	r, err := NewRegistry(
+		&Command{Name: "/echo", Aliases: []string{"/e"}, Args: "<text>", Help: "say it back", Where: Both, Run: echo},
+		&Command{Name: "/mine", Help: "only here", Where: Local, Run: echo},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Register(&Command{Name: "/e", Where: Local, Run: echo}); err == nil {
+		t.Error("registered /e twice")
+	}
+	policy := NewPolicy()
+	policy.Allow("/echo", AnyPeer)
+	r.SetPolicy(policy)
+
+	var tests = []struct {
+		line   string
+		remote bool
+		res    string
+		err    error
+	}{
+		{"/echo  hi there\n", false, "/echo:hi there", nil},
+		{"/e hi\n", true, "/echo:hi", nil},
+		{"/mine\n", false, "/mine:", nil},
+		{"/mine\n", true, "", ErrNotHere},
+		{"/nope\n", false, "", ErrUnknownCommand},
+	}
+	for _, test := range tests {
+		var from *ChatMessage
+		if test.remote {
+			from = &ChatMessage{Message: test.line, SenderID: testPeer}
+		}
+		if valid := r.Valid(test.line, test.remote); valid != (test.err == nil) {
+			t.Errorf("Valid(%q, %v) = %v", test.line, test.remote, valid)
+		}
+		res, err := r.Run(test.line, from)
+		if !errors.Is(err, test.err) {
+			t.Errorf("Run(%q) error = %v, wanted %v", test.line, err, test.err)
+		}
+		if err == nil && res.Message != test.res {
+			t.Errorf("Run(%q) = %q, wanted %q", test.line, res.Message, test.res)
+		}
+	}
+
+	// nobody runs /echo once it is revoked
+	policy.Revoke(AnyCommand, AnyPeer)
+	if _, err := r.Run("/echo hi\n", &ChatMessage{SenderID: testPeer}); !errors.Is(err, ErrDenied) {
+		t.Errorf("revoked /echo ran, error = %v", err)
+	}
+
+	help := r.Help()
+	if !strings.Contains(help, "/echo <text>") || !strings.Contains(help, "(also /e)") {
+		t.Errorf("help is missing /echo:\n%s", help)
+	}
+}
@@ -0,0 +1,174 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	logging "github.com/ipfs/go-log/v2"
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	drouting "github.com/libp2p/go-libp2p/p2p/discovery/routing"
+	dutil "github.com/libp2p/go-libp2p/p2p/discovery/util"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+var log = logging.Logger("chat")
+
+// searchInterval is the pause between rounds of looking for peers
+const searchInterval = 5 * time.Second
+
+// DHTDiscovery finds room members through a Kademlia DHT. One is enough
+// for all the rooms on a host: pass it to each with WithDiscovery.
+type DHTDiscovery struct {
+	*drouting.RoutingDiscovery
+	dht *dht.IpfsDHT
+}
+
+// ErrUnreachable means none of the bootstrap peers answered
+var ErrUnreachable = errors.New("chat: no bootstrap peer is reachable")
+
+// DefaultBootstrapPeers are the public IPFS bootstrappers
+func DefaultBootstrapPeers() []peer.AddrInfo {
+	infos, _ := peer.AddrInfosFromP2pAddrs(dht.DefaultBootstrapPeers...)
+	return infos
+}
+
+// ParseBootstrap reads a -bootstrap style list: "default" for the public
+// bootstrappers, "none" (or nothing) for none at all, otherwise
+// comma separated multiaddrs ending in /p2p/<id>.
+func ParseBootstrap(s string) ([]peer.AddrInfo, error) {
+	switch strings.TrimSpace(s) {
+	case "default":
+		return DefaultBootstrapPeers(), nil
+	case "", "none":
+		return nil, nil
+	}
+	return ParseAddrs(s)
+}
+
+// ParseAddrs turns comma separated full multiaddrs into AddrInfos,
+// merging the addresses given for the same peer.
+func ParseAddrs(s string) ([]peer.AddrInfo, error) {
+	var addrs []ma.Multiaddr
+	for _, a := range strings.Split(s, ",") {
+		a = strings.TrimSpace(a)
+		if a == "" {
+			continue
+		}
+		addr, err := ma.NewMultiaddr(a)
+		if err != nil {
+			return nil, fmt.Errorf("bad address %q: %v", a, err)
+		}
+		addrs = append(addrs, addr)
+	}
+	return peer.AddrInfosFromP2pAddrs(addrs...)
+}
+
+// NewDHTDiscovery starts a DHT on h and connects it to the bootstrap peers.
+// With no bootstrap peers at all, the DHT runs in server mode so that peers
+// on an isolated network (found through Connect or mDNS) can serve each other.
+// It fails with ErrUnreachable when bootstrap peers were given but none answer.
+func NewDHTDiscovery(ctx context.Context, h host.Host, bootstrap []peer.AddrInfo) (*DHTDiscovery, error) {
+	opts := []dht.Option{dht.BootstrapPeers(bootstrap...)}
+	if len(bootstrap) == 0 {
+		opts = append(opts, dht.Mode(dht.ModeServer))
+	}
+	// Start a DHT, for use in peer discovery. We can't just make a new DHT
+	// client because we want each peer to maintain its own local copy of the
+	// DHT, so that the bootstrapping node of the DHT can go down without
+	// inhibiting future peer discovery.
+	kademliaDHT, err := dht.New(ctx, h, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if err = kademliaDHT.Bootstrap(ctx); err != nil {
+		kademliaDHT.Close()
+		return nil, err
+	}
+	if n := Connect(ctx, h, bootstrap); len(bootstrap) > 0 && n == 0 {
+		kademliaDHT.Close()
+		return nil, ErrUnreachable
+	}
+
+	return &DHTDiscovery{
+		RoutingDiscovery: drouting.NewRoutingDiscovery(kademliaDHT),
+		dht:              kademliaDHT,
+	}, nil
+}
+
+// Connect dials all of peers at once, returning how many we reached.
+// Our own ID is skipped.
+func Connect(ctx context.Context, h host.Host, peers []peer.AddrInfo) int {
+	var (
+		wg sync.WaitGroup
+		mu sync.Mutex
+		n  int
+	)
+	for _, peerinfo := range peers {
+		if peerinfo.ID == h.ID() {
+			continue
+		}
+		wg.Add(1)
+		go func(pi peer.AddrInfo) {
+			defer wg.Done()
+			if err := h.Connect(ctx, pi); err != nil {
+				log.Warnf("could not connect to %s: %v", pi.ID, err)
+				return
+			}
+			mu.Lock()
+			n++
+			mu.Unlock()
+		}(peerinfo)
+	}
+	wg.Wait()
+	return n
+}
+
+// Close shuts down the DHT
+func (d *DHTDiscovery) Close() error {
+	return d.dht.Close()
+}
+
+// discoverPeers advertises the room's topic and connects to whoever else did,
+// until at least one of them answers
+func (cr *ChatRoom) discoverPeers() {
+	topicname := cr.topic.String()
+	dutil.Advertise(cr.ctx, cr.disc, topicname)
+
+	// Look for others who have announced and attempt to connect to them
+	anyConnected := false
+	for !anyConnected {
+		cr.emit(&Event{Type: EventSearching, Text: "Searching for peers..."})
+		peerChan, err := cr.disc.FindPeers(cr.ctx, topicname)
+		if err != nil {
+			cr.emit(&Event{Type: EventError, Text: "find peers", Err: err})
+			return
+		}
+		for p := range peerChan {
+			if p.ID == cr.self {
+				continue // No self connection
+			}
+			if err := cr.h.Connect(cr.ctx, p); err != nil {
+				cr.emit(&Event{Type: EventConnectFailed, Peer: p.ID, Err: err})
+			} else {
+				cr.emit(&Event{Type: EventConnected, Peer: p.ID})
+				anyConnected = true
+			}
+		}
+		if anyConnected {
+			break
+		}
+		select {
+		case <-time.After(searchInterval):
+		case <-cr.ctx.Done():
+			return
+		}
+	}
+	cr.emit(&Event{Type: EventDiscoveryDone, Text: "Peer discovery complete"})
+}
@@ -0,0 +1,113 @@
+package chat
+
+import (
+	"fmt"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// EventType says what an Event is about
+type EventType int
+
+const (
+	// EventSearching is sent each time discovery starts a round of looking for peers
+	EventSearching EventType = iota
+	// EventConnected is sent when discovery connects us to a peer in the room
+	EventConnected
+	// EventConnectFailed is sent when discovery found a peer we could not reach
+	EventConnectFailed
+	// EventDiscoveryDone is sent once discovery has found somebody
+	EventDiscoveryDone
+	// EventError reports something that went wrong in the background
+	EventError
+	// EventRejected is sent for a message we dropped, forged or unreadable
+	EventRejected
+	// EventCaughtUp is sent when we are done fetching the history we missed
+	EventCaughtUp
+	// EventOffer is sent when a peer offers us a file, see ChatRoom.Accept
+	EventOffer
+	// EventProgress reports how far a file transfer has got
+	EventProgress
+	// EventNick is sent when somebody changes nickname, or takes one
+	// somebody else has (Err says who)
+	EventNick
+	// EventJoin is sent when somebody turns up in the room, Text is their nick
+	EventJoin
+	// EventLeave is sent when somebody leaves, or we stop hearing from them
+	EventLeave
+)
+
+var eventNames = map[EventType]string{
+	EventSearching:     "searching",
+	EventConnected:     "connected",
+	EventConnectFailed: "connect-failed",
+	EventDiscoveryDone: "discovery-done",
+	EventError:         "error",
+	EventRejected:      "rejected",
+	EventCaughtUp:      "caught-up",
+	EventOffer:         "offer",
+	EventProgress:      "progress",
+	EventNick:          "nick",
+	EventJoin:          "join",
+	EventLeave:         "leave",
+}
+
+func (t EventType) String() string {
+	if s, ok := eventNames[t]; ok {
+		return s
+	}
+	return fmt.Sprintf("event(%d)", int(t))
+}
+
+// Event is anything, other than a message, that happens in a room
+type Event struct {
+	Type EventType
+	Room string
+	Peer peer.ID
+	Text string
+	Err  error
+}
+
+func (ev *Event) String() string {
+	s := ev.Type.String()
+	if ev.Peer != "" {
+		s += " " + ev.Peer.String()
+	}
+	if ev.Text != "" {
+		s += " " + ev.Text
+	}
+	if ev.Err != nil {
+		s += ": " + ev.Err.Error()
+	}
+	return s
+}
+
+// tryEmit is emit for those who cannot wait: if Events is full, ev is dropped
+func (cr *ChatRoom) tryEmit(ev *Event) {
+	ev.Room = cr.roomName
+	cr.count(ev)
+	// counted in wg, as the validator and others outside it call this too:
+	// Events stays open until we are done
+	if !cr.track() {
+		return
+	}
+	defer cr.wg.Done()
+	select {
+	case cr.Events <- ev:
+	default:
+	}
+}
+
+// emit hands ev to whoever reads Events, unless the room is closing
+func (cr *ChatRoom) emit(ev *Event) {
+	ev.Room = cr.roomName
+	cr.count(ev)
+	if !cr.track() {
+		return
+	}
+	defer cr.wg.Done()
+	select {
+	case cr.Events <- ev:
+	case <-cr.ctx.Done():
+	}
+}
@@ -0,0 +1,255 @@
+package chat
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	pb "github.com/libp2p/go-libp2p-pubsub/pb"
+)
+
+// HistoryKeep is how many records per room History keeps in memory
+const HistoryKeep = 1000
+
+// Record is one public message in a room's history. Raw is the message
+// exactly as it came off the topic, signature and all, so that a record
+// passed on to somebody else still proves who wrote it.
+type Record struct {
+	ID   string    `json:"id"` // hex of the pubsub message ID
+	Time time.Time `json:"time"`
+	Raw  []byte    `json:"raw"`
+
+	Message *ChatMessage `json:"-"`
+}
+
+// History is an append-only store of what was said in each room, one
+// file of JSON lines per room under its directory.
+type History struct {
+	dir string
+
+	mu    sync.Mutex
+	rooms map[string]*roomLog
+}
+
+type roomLog struct {
+	f      *os.File
+	seen   map[string]bool
+	recent []*Record
+}
+
+// OpenHistory keeps history in dir, which is created if need be
+func OpenHistory(dir string) (*History, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &History{dir: dir, rooms: make(map[string]*roomLog)}, nil
+}
+
+// newRecord turns a message from the topic into a Record
+func newRecord(msg *pubsub.Message, cm *ChatMessage) (*Record, error) {
+	raw, err := msg.Message.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	return &Record{ID: hex.EncodeToString([]byte(msg.ID)), Time: time.Now(), Raw: raw, Message: cm}, nil
+}
+
+// openRecord checks a Record somebody (maybe ourselves, from disk) hands
+// us: the signature must hold, and the message inside must be what its
+// ID says. Message is filled in.
+func openRecord(rec *Record) error {
+	m := new(pb.Message)
+	if err := m.Unmarshal(rec.Raw); err != nil {
+		return err
+	}
+	if err := verifySignature(m); err != nil {
+		return err
+	}
+	if hex.EncodeToString([]byte(pubsub.DefaultMsgIdFn(m))) != rec.ID {
+		return errors.New("chat: record ID does not match its message")
+	}
+	env := new(Envelope)
+	if err := json.Unmarshal(m.Data, env); err != nil {
+		return err
+	}
+	cm, err := checkEnvelope(env, peer.ID(m.GetFrom()))
+	if err != nil {
+		return err
+	}
+	cm.ID = rec.ID
+	rec.Message = cm
+	return nil
+}
+
+// verifySignature is the check gossipsub does on the messages it receives
+func verifySignature(m *pb.Message) error {
+	if m.Signature == nil {
+		return ErrUnsigned
+	}
+	pid, err := peer.IDFromBytes(m.From)
+	if err != nil {
+		return err
+	}
+	pubk, err := pid.ExtractPublicKey()
+	if err != nil {
+		return err
+	}
+	xm := *m
+	xm.Signature = nil
+	xm.Key = nil
+	bytes, err := xm.Marshal()
+	if err != nil {
+		return err
+	}
+	valid, err := pubk.Verify(append([]byte(pubsub.SignPrefix), bytes...), m.Signature)
+	if err != nil {
+		return err
+	}
+	if !valid {
+		return errors.New("chat: invalid signature")
+	}
+	return nil
+}
+
+// room opens (and the first time, reads back) the log of roomName.
+// Call with h.mu held.
+func (h *History) room(roomName string) (*roomLog, error) {
+	if rl, ok := h.rooms[roomName]; ok {
+		return rl, nil
+	}
+	path := filepath.Join(h.dir, url.PathEscape(roomName)+".jsonl")
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	rl := &roomLog{f: f, seen: make(map[string]bool)}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 4*maxPrivateSize)
+	for scanner.Scan() {
+		rec := new(Record)
+		if json.Unmarshal(scanner.Bytes(), rec) != nil || openRecord(rec) != nil {
+			continue // a torn last line, most likely
+		}
+		rl.add(rec)
+	}
+	h.rooms[roomName] = rl
+	return rl, nil
+}
+
+func (rl *roomLog) add(rec *Record) {
+	rl.seen[rec.ID] = true
+	rl.recent = append(rl.recent, rec)
+	if len(rl.recent) > HistoryKeep {
+		rl.recent = rl.recent[len(rl.recent)-HistoryKeep:]
+	}
+}
+
+// Add appends rec to the history of roomName. It returns false, and
+// writes nothing, if we already have the message.
+func (h *History) Add(roomName string, rec *Record) (bool, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	rl, err := h.room(roomName)
+	if err != nil {
+		return false, err
+	}
+	if rl.seen[rec.ID] {
+		return false, nil
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return false, err
+	}
+	if _, err := rl.f.Write(append(line, '\n')); err != nil {
+		return false, err
+	}
+	rl.add(rec)
+	return true, nil
+}
+
+// Seen tells whether the message with this (hex) ID is in the history of roomName
+func (h *History) Seen(roomName string, id string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	rl, err := h.room(roomName)
+	return err == nil && rl.seen[id]
+}
+
+// Last returns up to n of the latest records of roomName, oldest first
+func (h *History) Last(roomName string, n int) ([]*Record, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	rl, err := h.room(roomName)
+	if err != nil {
+		return nil, err
+	}
+	return rl.last(n), nil
+}
+
+// After returns up to n of the records of roomName that came after the one
+// with this ID, oldest first: in the order they reached us, which is all
+// peers can agree on. If we do not have that one, it is the latest n.
+func (h *History) After(roomName string, id string, n int) ([]*Record, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	rl, err := h.room(roomName)
+	if err != nil {
+		return nil, err
+	}
+	if rl.seen[id] {
+		for i := len(rl.recent) - 1; i >= 0; i-- {
+			if rl.recent[i].ID == id {
+				recs := rl.recent[i+1:]
+				if len(recs) > n {
+					recs = recs[:n]
+				}
+				return append([]*Record(nil), recs...), nil
+			}
+		}
+	}
+	return rl.last(n), nil
+}
+
+func (rl *roomLog) last(n int) []*Record {
+	if n <= 0 {
+		return nil
+	}
+	if n > len(rl.recent) {
+		n = len(rl.recent)
+	}
+	return append([]*Record(nil), rl.recent[len(rl.recent)-n:]...)
+}
+
+// Sync flushes every room's file to disk
+func (h *History) Sync() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var first error
+	for _, rl := range h.rooms {
+		if err := rl.f.Sync(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// Close flushes and closes the history
+func (h *History) Close() error {
+	err := h.Sync()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for name, rl := range h.rooms {
+		rl.f.Close()
+		delete(h.rooms, name)
+	}
+	return err
+}
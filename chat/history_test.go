@@ -0,0 +1,121 @@
+package chat
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+func TestCatchUp(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	ha, hb := loopbackHost(t), loopbackHost(t)
+	hista, err := OpenHistory(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	histb, err := OpenHistory(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// alice talks to herself for a while
+	a, err := JoinChatRoom(ctx, WithHost(ha), WithNick("alice"), WithRoom("late"), WithHistory(hista))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	said := []string{"one\n", "two\n", "/iam\n", "three\n"}
+	for _, s := range said {
+		if err := a.Publish(s, "", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for {
+		recs, _ := hista.Last("late", 10)
+		if len(recs) == 3 { // commands are not history
+			break
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatalf("alice remembers %d messages, wanted 3", len(recs))
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	// then bob turns up
+	Connect(ctx, hb, []peer.AddrInfo{{ID: ha.ID(), Addrs: ha.Addrs()}})
+	b, err := JoinChatRoom(ctx, WithHost(hb), WithNick("bob"), WithRoom("late"), WithHistory(histb))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	for _, want := range []string{"one\n", "two\n", "three\n"} {
+		select {
+		case cm := <-b.Messages:
+			if cm.Message != want || cm.SenderNick != "alice" {
+				t.Errorf("caught up on %q from %q, wanted %q from alice", cm.Message, cm.SenderNick, want)
+			}
+		case <-ctx.Done():
+			t.Fatalf("never caught up on %q", want)
+		}
+	}
+
+	// what bob caught up on is his, and read back the same
+	histb.Close()
+	again, err := OpenHistory(histb.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer again.Close()
+	recs, err := again.Last("late", 10)
+	if err != nil || len(recs) != 3 {
+		t.Fatalf("bob's history has %d records (%v), wanted 3", len(recs), err)
+	}
+	if added, _ := again.Add("late", recs[0]); added {
+		t.Error("the same message went in twice")
+	}
+
+	// a forged record is no good
+	recs[0].Raw[len(recs[0].Raw)-1] ^= 1
+	if err := openRecord(recs[0]); err == nil {
+		t.Error("a tampered record passed")
+	}
+}
+
+func TestHistoryAfter(t *testing.T) {
+	hist, err := OpenHistory(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hist.Close()
+	for _, id := range []string{"1", "2", "3", "4", "5"} {
+		if _, err := hist.Add("room", &Record{ID: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var tests = []struct {
+		after string
+		n     int
+		want  string
+	}{
+		{"2", 2, "34"},
+		{"2", 10, "345"},
+		{"5", 2, ""},
+		{"unknown", 2, "45"}, // not ours: the latest
+		{"", 10, "12345"},
+		{"", 0, ""},
+	}
+	for _, test := range tests {
+		recs, err := hist.After("room", test.after, test.n)
+		got := ""
+		for _, rec := range recs {
+			got += rec.ID
+		}
+		if err != nil || got != test.want {
+			t.Errorf("After(%q, %d) = %q, %v, wanted %q", test.after, test.n, got, err, test.want)
+		}
+	}
+}
@@ -0,0 +1,275 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// ErrNoRoom means there is no active room to talk in
+var ErrNoRoom = errors.New("chat: not in any room")
+
+// Manager keeps us in several rooms at once. What the rooms receive comes
+// out, tagged with the room's name, on the Manager's own channels; what we
+// say goes to the active room.
+type Manager struct {
+	// Messages from all the rooms, see ChatMessage.Room
+	Messages chan *ChatMessage
+	// Data from all the rooms
+	Data chan *ChatData
+	// Events from all the rooms
+	Events chan *Event
+
+	ctx  context.Context
+	opts []Option
+
+	mu     sync.Mutex
+	rooms  map[string]*ChatRoom
+	active string
+}
+
+// NewManager returns a Manager that joins rooms with opts (WithRoom aside,
+// that one is given to Join). The rooms share one pubsub: the one given
+// with WithPubSub, or else one from NewGossipSub.
+func NewManager(ctx context.Context, opts ...Option) (*Manager, error) {
+	probe := new(ChatRoom)
+	for _, opt := range opts {
+		if err := opt(probe); err != nil {
+			return nil, err
+		}
+	}
+	if probe.h == nil {
+		return nil, errNoHost
+	}
+	if probe.ps == nil {
+		ps, err := NewGossipSub(ctx, probe.h)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, WithPubSub(ps))
+	}
+	return &Manager{
+		Messages: make(chan *ChatMessage, ChatRoomBufSize),
+		Data:     make(chan *ChatData, ChatRoomBufSize),
+		Events:   make(chan *Event, ChatRoomBufSize),
+		ctx:      ctx,
+		opts:     opts,
+		rooms:    make(map[string]*ChatRoom),
+	}, nil
+}
+
+// Join enters roomName, which becomes the active room. Joining a room we
+// are already in just makes it active.
+func (m *Manager) Join(roomName string) (*ChatRoom, error) {
+	return m.join(roomName, true)
+}
+
+// Enter enters roomName like Join, but we go on talking in the active
+// room: roomName becomes active only if there was none
+func (m *Manager) Enter(roomName string) (*ChatRoom, error) {
+	return m.join(roomName, false)
+}
+
+func (m *Manager) join(roomName string, activate bool) (*ChatRoom, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	cr, ok := m.rooms[roomName]
+	if !ok {
+		opts := append(append([]Option{}, m.opts...), WithRoom(roomName))
+		var err error
+		if cr, err = JoinChatRoom(m.ctx, opts...); err != nil {
+			return nil, err
+		}
+		m.rooms[roomName] = cr
+		go m.forward(cr)
+	}
+	if _, ok := m.rooms[m.active]; activate || !ok {
+		m.active = roomName
+	}
+	return cr, nil
+}
+
+// Leave closes roomName: its subscription, readers and discovery stop.
+// If it was the active room, another one (if any is left) takes over.
+func (m *Manager) Leave(roomName string) error {
+	m.mu.Lock()
+	cr, ok := m.rooms[roomName]
+	if !ok {
+		m.mu.Unlock()
+		return fmt.Errorf("not in %s", roomName)
+	}
+	delete(m.rooms, roomName)
+	if m.active == roomName {
+		m.active = ""
+		if names := m.names(); len(names) > 0 {
+			m.active = names[0]
+		}
+	}
+	m.mu.Unlock()
+	return cr.Close()
+}
+
+// Active is the room we talk in, nil if we are in none
+func (m *Manager) Active() *ChatRoom {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.rooms[m.active]
+}
+
+// SetActive switches to a room we already joined
+func (m *Manager) SetActive(roomName string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.rooms[roomName]; !ok {
+		return fmt.Errorf("not in %s", roomName)
+	}
+	m.active = roomName
+	return nil
+}
+
+// Room finds one of our rooms by name
+func (m *Manager) Room(roomName string) (*ChatRoom, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	cr, ok := m.rooms[roomName]
+	return cr, ok
+}
+
+// Rooms lists the rooms we are in, sorted
+func (m *Manager) Rooms() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.names()
+}
+
+func (m *Manager) names() []string {
+	names := make([]string, 0, len(m.rooms))
+	for name := range m.rooms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Publish says something in the active room
+func (m *Manager) Publish(message string, to string, payload []byte) error {
+	cr := m.Active()
+	if cr == nil {
+		return ErrNoRoom
+	}
+	return cr.Publish(message, to, payload)
+}
+
+// SetNick changes our nickname in every room, and in those we join later.
+// Nothing changes unless the nickname is free in all of them.
+func (m *Manager) SetNick(nick string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, cr := range m.rooms {
+		if err := cr.nickFree(nick); err != nil {
+			return fmt.Errorf("%s: %w", cr.Room(), err)
+		}
+	}
+	m.opts = append(m.opts, WithNick(nick))
+	var first error
+	for _, name := range m.names() {
+		if err := m.rooms[name].SetNick(nick); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// SetStatus changes our status text in every room
+func (m *Manager) SetStatus(status string) error {
+	var first error
+	for _, name := range m.Rooms() {
+		if cr, ok := m.Room(name); ok {
+			if err := cr.SetStatus(status); err != nil && first == nil {
+				first = err
+			}
+		}
+	}
+	return first
+}
+
+// Offers lists the files offered to us, in every room
+func (m *Manager) Offers() []*Offer {
+	var offers []*Offer
+	for _, name := range m.Rooms() {
+		if cr, ok := m.Room(name); ok {
+			offers = append(offers, cr.Offers()...)
+		}
+	}
+	return offers
+}
+
+// Accept takes the file offered as id, whichever room it was offered in
+func (m *Manager) Accept(id string) error {
+	return m.decide(id, (*ChatRoom).Accept)
+}
+
+// Refuse turns the file offered as id down, whichever room it was offered in
+func (m *Manager) Refuse(id string) error {
+	return m.decide(id, (*ChatRoom).Refuse)
+}
+
+func (m *Manager) decide(id string, decide func(*ChatRoom, string) error) error {
+	for _, o := range m.Offers() {
+		if o.ID == id {
+			if cr, ok := m.Room(o.Room); ok {
+				return decide(cr, id)
+			}
+		}
+	}
+	return fmt.Errorf("%w: %s", ErrNoOffer, id)
+}
+
+// Close leaves every room
+func (m *Manager) Close() error {
+	var first error
+	for _, name := range m.Rooms() {
+		if err := m.Leave(name); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// forward passes on what cr receives, until cr is closed
+func (m *Manager) forward(cr *ChatRoom) {
+	msgs, data, events := cr.Messages, cr.Data, cr.Events
+	for msgs != nil || data != nil || events != nil {
+		select {
+		case cm, ok := <-msgs:
+			if !ok {
+				msgs = nil
+				continue
+			}
+			select {
+			case m.Messages <- cm:
+			case <-m.ctx.Done():
+			}
+		case d, ok := <-data:
+			if !ok {
+				data = nil
+				continue
+			}
+			select {
+			case m.Data <- d:
+			case <-m.ctx.Done():
+			}
+		case ev, ok := <-events:
+			if !ok {
+				events = nil
+				continue
+			}
+			select {
+			case m.Events <- ev:
+			case <-m.ctx.Done():
+			}
+		}
+	}
+}
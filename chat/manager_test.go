@@ -0,0 +1,75 @@
+package chat
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+func TestManager(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	ha, hb := loopbackHost(t), loopbackHost(t)
+	Connect(ctx, ha, []peer.AddrInfo{{ID: hb.ID(), Addrs: hb.Addrs()}})
+
+	ma, err := NewManager(ctx, WithHost(ha), WithNick("alice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mb, err := NewManager(ctx, WithHost(hb), WithNick("bob"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ma.Close()
+	defer mb.Close()
+	for _, name := range []string{"one", "two"} {
+		if _, err := ma.Join(name); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := mb.Join(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := ma.Active().Room(); got != "two" {
+		t.Errorf("active room is %q, wanted the last joined %q", got, "two")
+	}
+
+	// entering a room, we go on talking where we were
+	if _, err := ma.Enter("three"); err != nil {
+		t.Fatal(err)
+	}
+	if got := ma.Active().Room(); got != "two" || len(ma.Rooms()) != 3 {
+		t.Errorf("after entering three, active %q in %v, wanted two", got, ma.Rooms())
+	}
+	if err := ma.Leave("three"); err != nil {
+		t.Fatal(err)
+	}
+
+	// leaving the active room hands over to the one that is left
+	if err := ma.Leave("two"); err != nil {
+		t.Fatal(err)
+	}
+	if got := ma.Rooms(); len(got) != 1 || ma.Active().Room() != "one" {
+		t.Errorf("after leaving, rooms = %v active %q, wanted [one] active one", got, ma.Active().Room())
+	}
+
+	one, _ := mb.Room("one")
+	for len(one.ListPeers()) == 0 {
+		select {
+		case <-ctx.Done():
+			t.Fatal("peers never met in room one")
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	resend(t, ctx, func() error { return ma.Publish("hi one\n", "", nil) })
+	select {
+	case cm := <-mb.Messages:
+		if cm.Room != "one" {
+			t.Errorf("message tagged %q, wanted %q", cm.Room, "one")
+		}
+	case <-ctx.Done():
+		t.Fatal("message never arrived")
+	}
+}
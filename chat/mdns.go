@@ -0,0 +1,38 @@
+package chat
+
+import (
+	"context"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/p2p/discovery/mdns"
+)
+
+// MDNSServiceTag is the name under which chat peers find each other on a LAN
+const MDNSServiceTag = "p2p-chat"
+
+// mdnsNotifee connects to every peer mDNS turns up
+type mdnsNotifee struct {
+	ctx context.Context
+	h   host.Host
+}
+
+func (n *mdnsNotifee) HandlePeerFound(pi peer.AddrInfo) {
+	if pi.ID == n.h.ID() {
+		return
+	}
+	ctx, cancel := context.WithTimeout(n.ctx, 10*time.Second)
+	defer cancel()
+	n.h.Connect(ctx, pi) // gossipsub takes it from here
+}
+
+// StartMDNS connects h to the chat peers on the local network, no
+// bootstrap peers needed. Close the service to stop.
+func StartMDNS(ctx context.Context, h host.Host) (mdns.Service, error) {
+	s := mdns.NewMdnsService(h, MDNSServiceTag, &mdnsNotifee{ctx: ctx, h: h})
+	if err := s.Start(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
@@ -0,0 +1,253 @@
+package chat
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// MaxNickLength is the longest nickname SetNick takes
+const MaxNickLength = 32
+
+var (
+	// ErrNickTaken means somebody else in the room goes by that nickname
+	ErrNickTaken = errors.New("chat: nickname taken")
+	// ErrBadNick means a nickname we cannot use
+	ErrBadNick = errors.New("chat: nicknames are 1 to 32 characters, no spaces or '~'")
+)
+
+// Directory keeps the nickname each peer in a room last used. Nicknames
+// are not unique: two peers may claim the same one, Peers tells.
+type Directory struct {
+	mu    sync.Mutex
+	nicks map[peer.ID]string
+}
+
+// NewDirectory returns an empty Directory
+func NewDirectory() *Directory {
+	return &Directory{nicks: make(map[peer.ID]string)}
+}
+
+// Set records nick for p, returning the one p had before, if any
+func (d *Directory) Set(p peer.ID, nick string) (old string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	old = d.nicks[p]
+	d.nicks[p] = nick
+	return old
+}
+
+// Nick is what p goes by, empty if we don't know
+func (d *Directory) Nick(p peer.ID) string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.nicks[p]
+}
+
+// Peers lists who goes by nick
+func (d *Directory) Peers(nick string) []peer.ID {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var found []peer.ID
+	for p, n := range d.nicks {
+		if n == nick {
+			found = append(found, p)
+		}
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i] < found[j] })
+	return found
+}
+
+// Forget drops p
+func (d *Directory) Forget(p peer.ID) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.nicks, p)
+}
+
+// All is every peer we know a nickname for
+func (d *Directory) All() map[peer.ID]string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	all := make(map[peer.ID]string, len(d.nicks))
+	for p, n := range d.nicks {
+		all[p] = n
+	}
+	return all
+}
+
+// CheckNick tells whether nick is one we can use
+func CheckNick(nick string) error {
+	if nick == "" || len(nick) > MaxNickLength || strings.ContainsAny(nick, " \t\n~") {
+		return ErrBadNick
+	}
+	return nil
+}
+
+// Nicks is the room's directory of nicknames
+func (cr *ChatRoom) Nicks() *Directory {
+	return cr.nicks
+}
+
+// SetNick changes the nickname we use in the room, and announces it. A
+// nickname some other member goes by is refused, with ErrNickTaken.
+func (cr *ChatRoom) SetNick(nick string) error {
+	if err := cr.nickFree(nick); err != nil {
+		return err
+	}
+	cr.mu.Lock()
+	cr.nick = nick
+	cr.mu.Unlock()
+	cr.nicks.Set(cr.self, nick)
+	// an empty message: it carries the new nick, and says nothing else
+	return cr.Publish("", "", nil)
+}
+
+// nickFree says whether we can go by nick in this room
+func (cr *ChatRoom) nickFree(nick string) error {
+	if err := CheckNick(nick); err != nil {
+		return err
+	}
+	for _, p := range cr.nicks.Peers(nick) {
+		if p != cr.self && cr.isMember(p) {
+			return fmt.Errorf("%w: %s is %s~%s", ErrNickTaken, nick, nick, ShortID(p))
+		}
+	}
+	return nil
+}
+
+// noteNick keeps the directory up to date with the (verified) sender of cm,
+// telling when somebody changes nickname, or takes one somebody else has
+func (cr *ChatRoom) noteNick(cm *ChatMessage) {
+	p := senderID(cm)
+	if p == "" || p == cr.self || CheckNick(cm.SenderNick) != nil {
+		return
+	}
+	old := cr.nicks.Set(p, cm.SenderNick)
+	if old == cm.SenderNick {
+		return
+	}
+	ev := &Event{Type: EventNick, Peer: p, Text: cm.SenderNick}
+	if old != "" {
+		ev.Text = old + " is now " + cm.SenderNick
+	}
+	for _, q := range cr.nicks.Peers(cm.SenderNick) {
+		if q != p && (q == cr.self || cr.isMember(q)) {
+			ev.Err = fmt.Errorf("%w: %s~%s has it too", ErrNickTaken, cm.SenderNick, ShortID(q))
+			break
+		}
+	}
+	if old == "" && ev.Err == nil {
+		return // somebody new, nothing to tell
+	}
+	cr.tryEmit(ev)
+}
+
+// isMember tells whether p is in the room, or connected to us at least
+func (cr *ChatRoom) isMember(p peer.ID) bool {
+	for _, q := range cr.members() {
+		if q == p {
+			return true
+		}
+	}
+	return false
+}
+
+// members are the peers we share the topic with, and those we are connected to
+func (cr *ChatRoom) members() []peer.ID {
+	var all []peer.ID
+	seen := make(map[peer.ID]bool)
+	for _, p := range append(cr.ListPeers(), cr.h.Network().Peers()...) {
+		if !seen[p] {
+			seen[p] = true
+			all = append(all, p)
+		}
+	}
+	return all
+}
+
+// FindPeer picks the room member (or connected peer) that name stands for:
+// a nickname, a full peer ID, nick~shortid as messages show senders, or
+// the short ID or enough of the start of the ID of somebody in the room.
+func (cr *ChatRoom) FindPeer(name string) (peer.ID, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", fmt.Errorf("who?")
+	}
+	if id, err := peer.Decode(name); err == nil {
+		return id, nil
+	}
+	members := cr.members()
+
+	// nick~shortid: the ID part decides, the nick had better agree
+	if nick, short, ok := strings.Cut(name, "~"); ok {
+		p, err := pick(name, cr.roomName, members, func(p peer.ID) bool {
+			return ShortID(p) == short
+		})
+		if err == nil && nick != "" && cr.nicks.Nick(p) != "" && cr.nicks.Nick(p) != nick {
+			return "", fmt.Errorf("%s is %s now", short, cr.nicks.Nick(p))
+		}
+		return p, err
+	}
+
+	byNick := func(p peer.ID) bool { return p != cr.self && cr.nicks.Nick(p) == name }
+	if p, err := pick(name, cr.roomName, members, byNick); !errors.Is(err, errNobody) {
+		return p, err
+	}
+	// by ID, only among those really in the room: most IDs start alike
+	long := len(name) >= minPrefix
+	return pick(name, cr.roomName, cr.inRoom(), func(p peer.ID) bool {
+		return name == ShortID(p) || long && strings.HasPrefix(p.String(), name)
+	})
+}
+
+// minPrefix is the least of an ID FindPeer takes: ed25519 IDs all start
+// with 12D3KooW, so a few characters past that
+const minPrefix = len("12D3KooW") + 4
+
+// inRoom are the peers we share the topic with, and those on the roster
+func (cr *ChatRoom) inRoom() []peer.ID {
+	var all []peer.ID
+	seen := map[peer.ID]bool{cr.self: true}
+	add := func(p peer.ID) {
+		if !seen[p] {
+			seen[p] = true
+			all = append(all, p)
+		}
+	}
+	for _, p := range cr.ListPeers() {
+		add(p)
+	}
+	for _, pr := range cr.Roster() {
+		add(pr.Peer)
+	}
+	return all
+}
+
+var errNobody = errors.New("nobody")
+
+// pick is the one peer in members that match says yes to
+func pick(name, room string, members []peer.ID, match func(peer.ID) bool) (peer.ID, error) {
+	var found []peer.ID
+	for _, p := range members {
+		if match(p) {
+			found = append(found, p)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return "", fmt.Errorf("%w called %q in %s", errNobody, name, room)
+	case 1:
+		return found[0], nil
+	}
+	var which []string
+	for _, p := range found {
+		which = append(which, ShortID(p))
+	}
+	sort.Strings(which)
+	return "", fmt.Errorf("%q could be any of %s", name, strings.Join(which, ", "))
+}
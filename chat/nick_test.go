@@ -0,0 +1,86 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/test"
+)
+
+func TestNick(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	a, b := joinPair(t, ctx, "nicks")
+
+	// a learns b's nick from what b says
+	resend(t, ctx, func() error { return b.Publish("hi\n", "", nil) })
+	<-a.Messages
+	for _, name := range []string{"bob", "bob~" + ShortID(b.Self()), ShortID(b.Self()), b.Self().String()[:20]} {
+		if p, err := a.FindPeer(name); err != nil || p != b.Self() {
+			t.Errorf("FindPeer(%q) = %s, %v, wanted %s", name, p, err, b.Self())
+		}
+	}
+	// not the header all IDs share, nor any text with the short ID in it
+	for _, name := range []string{b.Self().String()[:minPrefix-1], "xx" + ShortID(b.Self())} {
+		if p, err := a.FindPeer(name); err == nil {
+			t.Errorf("FindPeer(%q) = %s, wanted nobody", name, p)
+		}
+	}
+	// nor a peer that is connected, but not in the room
+	c := loopbackHost(t)
+	if err := c.Connect(ctx, peer.AddrInfo{ID: a.h.ID(), Addrs: a.h.Addrs()}); err != nil {
+		t.Fatal(err)
+	}
+	if p, err := a.FindPeer(c.ID().String()[:20]); err == nil {
+		t.Errorf("FindPeer found %s, who is not in the room", p)
+	}
+	if err := a.SetNick("bob"); !errors.Is(err, ErrNickTaken) {
+		t.Errorf("taking bob's nick: error = %v, wanted ErrNickTaken", err)
+	}
+	if err := a.SetNick("no spaces"); !errors.Is(err, ErrBadNick) {
+		t.Errorf("bad nick: error = %v, wanted ErrBadNick", err)
+	}
+
+	if err := b.SetNick("carol"); err != nil {
+		t.Fatal(err)
+	}
+	for done := false; !done; {
+		select {
+		case ev := <-a.Events:
+			if ev.Type == EventNick {
+				if ev.Text != "bob is now carol" || ev.Peer != b.Self() {
+					t.Errorf("nick event %v", ev)
+				}
+				done = true
+			}
+		case <-ctx.Done():
+			t.Fatal("nick change never arrived")
+		}
+	}
+	if p, err := a.FindPeer("carol"); err != nil || p != b.Self() {
+		t.Errorf("FindPeer(carol) = %s, %v", p, err)
+	}
+	if _, err := a.FindPeer("bob~" + ShortID(b.Self())); err == nil {
+		t.Error("found b by its old nick")
+	}
+}
+
+func TestPick(t *testing.T) {
+	p, q := test.RandPeerIDFatal(t), test.RandPeerIDFatal(t)
+	d := NewDirectory()
+	d.Set(p, "dup")
+	d.Set(q, "dup")
+	byNick := func(id peer.ID) bool { return d.Nick(id) == "dup" }
+	if _, err := pick("dup", "room", []peer.ID{p, q}, byNick); err == nil {
+		t.Error("two peers called dup, and pick chose one")
+	}
+	if got, err := pick("dup", "room", []peer.ID{q}, byNick); err != nil || got != q {
+		t.Errorf("pick = %s, %v, wanted %s", got, err, q)
+	}
+	if _, err := pick("dup", "room", nil, byNick); !errors.Is(err, errNobody) {
+		t.Errorf("pick from nobody: error = %v", err)
+	}
+}
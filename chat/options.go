@@ -0,0 +1,92 @@
+package chat
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/libp2p/go-libp2p/core/discovery"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+)
+
+// DefaultRoom is joined when no room is given
+const DefaultRoom = "akumuji"
+
+// Option configures a ChatRoom in JoinChatRoom
+type Option func(cr *ChatRoom) error
+
+// WithHost sets the libp2p host the room runs on. It is required.
+func WithHost(h host.Host) Option {
+	return func(cr *ChatRoom) error {
+		cr.h = h
+		return nil
+	}
+}
+
+// WithPubSub shares ps between rooms. Without it, the room starts its own gossipsub.
+func WithPubSub(ps *pubsub.PubSub) Option {
+	return func(cr *ChatRoom) error {
+		cr.ps = ps
+		return nil
+	}
+}
+
+// WithNick sets our nickname, DefaultNick is used if this is left out.
+func WithNick(nick string) Option {
+	return func(cr *ChatRoom) error {
+		cr.nick = nick
+		return nil
+	}
+}
+
+// WithRoom names the room to join, DefaultRoom otherwise.
+func WithRoom(roomName string) Option {
+	return func(cr *ChatRoom) error {
+		if roomName == "" {
+			return errors.New("chat: empty room name")
+		}
+		cr.roomName = roomName
+		return nil
+	}
+}
+
+// WithDiscovery advertises the room with d and uses it to find other members.
+// Without it, the room only hears from peers we are already connected to.
+func WithDiscovery(d discovery.Discovery) Option {
+	return func(cr *ChatRoom) error {
+		cr.disc = d
+		return nil
+	}
+}
+
+// WithCommands lets other peers run commands here, see CommandHandler.
+func WithCommands(handler CommandHandler) Option {
+	return func(cr *ChatRoom) error {
+		cr.commands = handler
+		return nil
+	}
+}
+
+// WithHistory keeps the room's public messages in h, and has the room catch
+// up on what it missed from the members already there when it joins.
+func WithHistory(h *History) Option {
+	return func(cr *ChatRoom) error {
+		cr.history = h
+		return nil
+	}
+}
+
+// DefaultNick generates a nickname based on the $USER environment variable and
+// the last 8 chars of a peer ID.
+func DefaultNick(p peer.ID) string {
+	return fmt.Sprintf("%s-%s", os.Getenv("USER"), ShortID(p))
+}
+
+// ShortID returns the last 8 chars of a base58-encoded peer id.
+func ShortID(p peer.ID) string {
+	pretty := p.String()
+	return pretty[len(pretty)-8:]
+}
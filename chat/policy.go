@@ -0,0 +1,257 @@
+package chat
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// AnyPeer stands for every peer in a Policy rule
+const AnyPeer = peer.ID("*")
+
+// AnyCommand stands for every command when revoking
+const AnyCommand = "*"
+
+// auditKeep is how many AuditEntries a Policy remembers
+const auditKeep = 100
+
+// ErrDenied is returned for a remote command the Policy turns down
+var ErrDenied = errors.New("not allowed")
+
+// Policy decides who may run which commands on our node. Nothing is allowed
+// until a rule says so: remote execution is opt-in, per command and per
+// (verified) peer ID. A denied peer gets nothing, whatever the rules say.
+// Every decision goes in the audit log.
+type Policy struct {
+	mu    sync.Mutex
+	allow map[string]map[peer.ID]bool
+	deny  map[peer.ID]bool
+	path  string // where Save writes, if anywhere
+
+	audit    []AuditEntry
+	auditLog io.Writer
+}
+
+// AuditEntry records one remote invocation
+type AuditEntry struct {
+	Time    time.Time `json:"time"`
+	Peer    peer.ID   `json:"peer"`
+	Command string    `json:"command"`
+	Allowed bool      `json:"allowed"`
+	Reason  string    `json:"reason,omitempty"`
+}
+
+func (e AuditEntry) String() string {
+	verdict := "allowed"
+	if !e.Allowed {
+		verdict = "denied: " + e.Reason
+	}
+	return fmt.Sprintf("%s %s %q %s", e.Time.Format("15:04:05"), e.Peer, e.Command, verdict)
+}
+
+// policyFile is how a Policy is kept on disk
+type policyFile struct {
+	Allow map[string][]string `json:"allow"`
+	Deny  []string            `json:"deny"`
+}
+
+// encodePeer and decodePeer know about AnyPeer, which is no real peer ID
+func encodePeer(id peer.ID) string {
+	if id == AnyPeer {
+		return string(AnyPeer)
+	}
+	return id.String()
+}
+
+func decodePeer(s string) (peer.ID, error) {
+	if s == string(AnyPeer) {
+		return AnyPeer, nil
+	}
+	return peer.Decode(s)
+}
+
+// NewPolicy returns a Policy that allows nothing
+func NewPolicy() *Policy {
+	return &Policy{allow: make(map[string]map[peer.ID]bool), deny: make(map[peer.ID]bool)}
+}
+
+// LoadPolicy reads the policy kept at path, an empty one if there is no file
+// yet. Save writes it back there.
+func LoadPolicy(path string) (*Policy, error) {
+	p := NewPolicy()
+	p.path = path
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return p, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var pf policyFile
+	if err := json.Unmarshal(b, &pf); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	for cmd, peers := range pf.Allow {
+		for _, s := range peers {
+			who, err := decodePeer(s)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", path, err)
+			}
+			p.Allow(cmd, who)
+		}
+	}
+	for _, s := range pf.Deny {
+		who, err := peer.Decode(s)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		p.Deny(who)
+	}
+	return p, nil
+}
+
+// Save writes the policy to where it was loaded from, if anywhere
+func (p *Policy) Save() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.path == "" {
+		return nil
+	}
+	pf := policyFile{Allow: make(map[string][]string)}
+	for cmd, peers := range p.allow {
+		for who := range peers {
+			pf.Allow[cmd] = append(pf.Allow[cmd], encodePeer(who))
+		}
+		sort.Strings(pf.Allow[cmd])
+	}
+	for who := range p.deny {
+		pf.Deny = append(pf.Deny, who.String())
+	}
+	sort.Strings(pf.Deny)
+	b, err := json.MarshalIndent(pf, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(p.path, b, 0600)
+}
+
+// SetAuditLog has every decision also written to w, one JSON object a line
+func (p *Policy) SetAuditLog(w io.Writer) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.auditLog = w
+}
+
+// Allow lets who (AnyPeer for everyone) run cmd on our node
+func (p *Policy) Allow(cmd string, who peer.ID) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.allow[cmd] == nil {
+		p.allow[cmd] = make(map[peer.ID]bool)
+	}
+	p.allow[cmd][who] = true
+}
+
+// Revoke takes back what Allow gave. AnyCommand revokes every command,
+// AnyPeer every peer.
+func (p *Policy) Revoke(cmd string, who peer.ID) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for name, peers := range p.allow {
+		if cmd != AnyCommand && name != cmd {
+			continue
+		}
+		if who == AnyPeer {
+			delete(p.allow, name)
+			continue
+		}
+		delete(peers, who)
+		if len(peers) == 0 {
+			delete(p.allow, name)
+		}
+	}
+}
+
+// Deny shuts who out of every command
+func (p *Policy) Deny(who peer.ID) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.deny[who] = true
+}
+
+// Undeny lifts Deny, the rules apply to who again
+func (p *Policy) Undeny(who peer.ID) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.deny, who)
+}
+
+// Check decides whether who may run line (the command cmd), and audits it
+func (p *Policy) Check(cmd string, line string, who peer.ID) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var err error
+	switch {
+	case who == "":
+		err = fmt.Errorf("%w: unknown sender", ErrDenied)
+	case p.deny[who]:
+		err = fmt.Errorf("%w: %s is denied", ErrDenied, who)
+	case !p.allow[cmd][who] && !p.allow[cmd][AnyPeer]:
+		err = fmt.Errorf("%w: %s may not run %s", ErrDenied, who, cmd)
+	}
+	entry := AuditEntry{Time: time.Now(), Peer: who, Command: strings.TrimSpace(line), Allowed: err == nil}
+	if err != nil {
+		entry.Reason = err.Error()
+	}
+	p.audit = append(p.audit, entry)
+	if len(p.audit) > auditKeep {
+		p.audit = p.audit[len(p.audit)-auditKeep:]
+	}
+	if p.auditLog != nil {
+		if b, jerr := json.Marshal(entry); jerr == nil {
+			p.auditLog.Write(append(b, '\n'))
+		}
+	}
+	return err
+}
+
+// Audit returns up to n of the latest decisions, oldest first
+func (p *Policy) Audit(n int) []AuditEntry {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if n > len(p.audit) {
+		n = len(p.audit)
+	}
+	return append([]AuditEntry{}, p.audit[len(p.audit)-n:]...)
+}
+
+// String lists the rules, for people to read
+func (p *Policy) String() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var lines []string
+	for cmd, peers := range p.allow {
+		var who []string
+		for id := range peers {
+			who = append(who, encodePeer(id))
+		}
+		sort.Strings(who)
+		lines = append(lines, fmt.Sprintf("allow %s: %s", cmd, strings.Join(who, " ")))
+	}
+	sort.Strings(lines)
+	for id := range p.deny {
+		lines = append(lines, "deny "+id.String())
+	}
+	if len(lines) == 0 {
+		return "no remote commands allowed"
+	}
+	return strings.Join(lines, "\n")
+}
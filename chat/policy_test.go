@@ -0,0 +1,67 @@
+package chat
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/test"
+)
+
+func TestPolicy(t *testing.T) {
+	alice, bob, carol := test.RandPeerIDFatal(t), test.RandPeerIDFatal(t), test.RandPeerIDFatal(t)
+	path := filepath.Join(t.TempDir(), "acl.json")
+	p, err := LoadPolicy(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var log bytes.Buffer
+	p.SetAuditLog(&log)
+
+	p.Allow("/iam", AnyPeer)
+	p.Allow("/fetch", alice)
+	p.Deny(bob)
+
+	var tests = []struct {
+		cmd string
+		who peer.ID
+		ok  bool
+	}{
+		{"/iam", alice, true},
+		{"/iam", bob, false}, // denied, whatever the rules
+		{"/fetch", alice, true},
+		{"/fetch", carol, false},
+		{"/peers", alice, false}, // nobody opted in
+		{"/iam", "", false},
+	}
+	for _, tt := range tests {
+		err := p.Check(tt.cmd, tt.cmd+"\n", tt.who)
+		if (err == nil) != tt.ok || (err != nil && !errors.Is(err, ErrDenied)) {
+			t.Errorf("Check(%s, %s) = %v, wanted ok: %v", tt.cmd, tt.who, err, tt.ok)
+		}
+	}
+	if got := len(p.Audit(100)); got != len(tests) {
+		t.Errorf("audited %d calls, wanted %d", got, len(tests))
+	}
+	if got := bytes.Count(log.Bytes(), []byte("\n")); got != len(tests) {
+		t.Errorf("audit log has %d lines, wanted %d", got, len(tests))
+	}
+
+	// the rules survive a restart
+	if err := p.Save(); err != nil {
+		t.Fatal(err)
+	}
+	again, err := LoadPolicy(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.String() != p.String() {
+		t.Errorf("loaded\n%s\nwanted\n%s", again, p)
+	}
+	again.Revoke("/fetch", alice)
+	if err := again.Check("/fetch", "/fetch\n", alice); err == nil {
+		t.Error("revoked /fetch still allowed")
+	}
+}
@@ -0,0 +1,197 @@
+package chat
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+)
+
+// DefaultHeartbeat is how often we tell a room we are still there
+const DefaultHeartbeat = 30 * time.Second
+
+// heartbeatsMissed is how many heartbeats a peer may miss before we take
+// it that it has gone
+const heartbeatsMissed = 3
+
+// joinBeatDelay gives gossipsub time to put a newcomer in our mesh, what
+// we publish before that is lost on it
+const joinBeatDelay = 2 * time.Second
+
+// Presence is what we know of somebody in the room
+type Presence struct {
+	Peer     peer.ID
+	Nick     string
+	Status   string
+	LastSeen time.Time
+	Self     bool
+}
+
+// WithHeartbeat has the room say we are there every d (DefaultHeartbeat
+// otherwise). Peers we have not heard from in a few of those are taken to
+// have left.
+func WithHeartbeat(d time.Duration) Option {
+	return func(cr *ChatRoom) error {
+		cr.heartbeat = d
+		return nil
+	}
+}
+
+// Roster lists who is in the room, ourselves included, by nickname
+func (cr *ChatRoom) Roster() []Presence {
+	cr.presMu.Lock()
+	roster := make([]Presence, 0, len(cr.roster)+1)
+	for _, pr := range cr.roster {
+		roster = append(roster, *pr)
+	}
+	status := cr.status
+	cr.presMu.Unlock()
+	roster = append(roster, Presence{Peer: cr.self, Nick: cr.Nick(), Status: status, LastSeen: time.Now(), Self: true})
+	sort.Slice(roster, func(i, j int) bool {
+		if roster[i].Nick != roster[j].Nick {
+			return roster[i].Nick < roster[j].Nick
+		}
+		return roster[i].Peer < roster[j].Peer
+	})
+	return roster
+}
+
+// Status is the status text we show in the room
+func (cr *ChatRoom) Status() string {
+	cr.presMu.Lock()
+	defer cr.presMu.Unlock()
+	return cr.status
+}
+
+// SetStatus changes our status text, and tells the room
+func (cr *ChatRoom) SetStatus(status string) error {
+	cr.presMu.Lock()
+	cr.status = status
+	cr.presMu.Unlock()
+	return cr.beat()
+}
+
+// beat is a heartbeat: an empty message, that carries nick and status
+func (cr *ChatRoom) beat() error {
+	return cr.Publish("", "", nil)
+}
+
+// byeTimeout bounds the goodbye Close says
+const byeTimeout = 2 * time.Second
+
+// bye tells the room we are leaving, so that it need not wait for our
+// heartbeats to stop. The room may be closing already: the goodbye has a
+// context of its own.
+func (cr *ChatRoom) bye() {
+	msg, err := encodeMessage(&ChatMessage{SenderID: cr.self.Pretty(), SenderNick: cr.Nick(), Leaving: true})
+	if err != nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), byeTimeout)
+	defer cancel()
+	cr.topic.Publish(ctx, msg)
+}
+
+// seen notes that the (verified) sender of cm is in the room
+func (cr *ChatRoom) seen(cm *ChatMessage) {
+	p := senderID(cm)
+	if p == "" || p == cr.self {
+		return
+	}
+	cr.presMu.Lock()
+	pr, ok := cr.roster[p]
+	if !ok {
+		pr = &Presence{Peer: p}
+		cr.roster[p] = pr
+	}
+	pr.Nick = cm.SenderNick
+	if cm.To == "" { // what we are told in private has no status
+		pr.Status = cm.Status
+	}
+	pr.LastSeen = time.Now()
+	cr.presMu.Unlock()
+	if !ok {
+		cr.tryEmit(&Event{Type: EventJoin, Peer: p, Text: cm.SenderNick})
+	}
+}
+
+// gone takes p off the roster
+func (cr *ChatRoom) gone(p peer.ID) {
+	cr.presMu.Lock()
+	pr, ok := cr.roster[p]
+	delete(cr.roster, p)
+	cr.presMu.Unlock()
+	if ok {
+		cr.tryEmit(&Event{Type: EventLeave, Peer: p, Text: pr.Nick})
+	}
+}
+
+// presenceLoop beats, and forgets peers who have stopped beating
+func (cr *ChatRoom) presenceLoop() {
+	cr.beat()
+	ticker := time.NewTicker(cr.heartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			cr.beat()
+			cr.expire(time.Now().Add(-heartbeatsMissed * cr.heartbeat))
+		case <-cr.ctx.Done():
+			return
+		}
+	}
+}
+
+// expire forgets those not heard from since then
+func (cr *ChatRoom) expire(then time.Time) {
+	var stale []peer.ID
+	cr.presMu.Lock()
+	for p, pr := range cr.roster {
+		if pr.LastSeen.Before(then) {
+			stale = append(stale, p)
+		}
+	}
+	cr.presMu.Unlock()
+	for _, p := range stale {
+		cr.gone(p)
+	}
+}
+
+// peerEvents follows the peers next to us joining and leaving the topic.
+// A newcomer gets a heartbeat soon after, so that it knows we are here;
+// its own tells us who it is.
+func (cr *ChatRoom) peerEvents(events *pubsub.TopicEventHandler) {
+	for {
+		ev, err := events.NextPeerEvent(cr.ctx)
+		if err != nil {
+			return
+		}
+		switch ev.Type {
+		case pubsub.PeerJoin:
+			cr.presMu.Lock()
+			due := !cr.beatDue
+			cr.beatDue = true
+			cr.presMu.Unlock()
+			if due {
+				time.AfterFunc(joinBeatDelay, cr.joinBeat)
+			}
+		case pubsub.PeerLeave:
+			cr.gone(ev.Peer)
+		}
+	}
+}
+
+// joinBeat is the heartbeat for newcomers
+func (cr *ChatRoom) joinBeat() {
+	if !cr.track() {
+		return
+	}
+	defer cr.wg.Done()
+	cr.presMu.Lock()
+	cr.beatDue = false
+	cr.presMu.Unlock()
+	cr.beat()
+}
@@ -0,0 +1,81 @@
+package chat
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// waitFor reads room events until one of type typ comes
+func waitFor(t *testing.T, ctx context.Context, cr *ChatRoom, typ EventType) *Event {
+	t.Helper()
+	for {
+		select {
+		case ev := <-cr.Events:
+			if ev.Type == typ {
+				return ev
+			}
+		case <-ctx.Done():
+			t.Fatalf("no %s event", typ)
+		}
+	}
+}
+
+func TestPresence(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	a, b := joinPair(t, ctx, "presence")
+
+	// b beats as soon as a turns up next to it
+	if ev := waitFor(t, ctx, a, EventJoin); ev.Peer != b.Self() || ev.Text != "bob" {
+		t.Errorf("join event %v, wanted bob", ev)
+	}
+	resend(t, ctx, func() error { return b.SetStatus("away") })
+	for {
+		roster := a.Roster()
+		if len(roster) != 2 || roster[0].Nick != "alice" || !roster[0].Self {
+			t.Fatalf("roster %v, wanted alice (self) and bob", roster)
+		}
+		if roster[1].Status == "away" {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatalf("bob's status is %q", roster[1].Status)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	b.Close()
+	if ev := waitFor(t, ctx, a, EventLeave); ev.Peer != b.Self() {
+		t.Errorf("leave event %v, wanted bob", ev)
+	}
+	if n := len(a.Roster()); n != 1 {
+		t.Errorf("%d in the roster after bob left, wanted 1", n)
+	}
+}
+
+func TestExpire(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	cr, err := JoinChatRoom(ctx, WithHost(loopbackHost(t)), WithRoom("expire"), WithHeartbeat(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cr.Close()
+	cr.seen(&ChatMessage{SenderID: testPeer, SenderNick: "ghost"})
+	if n := len(cr.Roster()); n != 2 {
+		t.Fatalf("%d in the roster, wanted 2", n)
+	}
+	cr.expire(time.Now().Add(-time.Minute)) // heard from since
+	if n := len(cr.Roster()); n != 2 {
+		t.Errorf("%d in the roster, wanted 2", n)
+	}
+	cr.expire(time.Now())
+	if n := len(cr.Roster()); n != 1 {
+		t.Errorf("%d in the roster after expiry, wanted 1", n)
+	}
+	if ev := waitFor(t, ctx, cr, EventLeave); ev.Text != "ghost" {
+		t.Errorf("leave event %v, wanted ghost", ev)
+	}
+}
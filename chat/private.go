@@ -0,0 +1,108 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// PrivateProtocol carries messages meant for one peer only. They go over a
+// direct stream, which libp2p encrypts and authenticates end to end, so
+// neither the text nor the recipient ever shows up on the room's topic.
+const PrivateProtocol = "/chat/private/1.0.0"
+
+const (
+	// maxPrivateSize bounds what we read from a private stream
+	maxPrivateSize = 1 << 20
+	privateTimeout = 30 * time.Second
+	// replyTimeout is how long we try to reach a peer to answer its command
+	replyTimeout = 5 * time.Second
+)
+
+// privateProtocol is per room, so that each room on a host gets its own messages
+func privateProtocol(roomName string) protocol.ID {
+	return protocol.ID(PrivateProtocol + "/" + roomName)
+}
+
+// sendPrivate delivers m to the peer `to` names, over a stream of its own
+func (cr *ChatRoom) sendPrivate(to string, m *ChatMessage) error {
+	p, err := cr.FindPeer(to)
+	if err != nil {
+		return err
+	}
+	return cr.sendTo(p, m)
+}
+
+// sendTo delivers m to p, over a stream of its own
+func (cr *ChatRoom) sendTo(p peer.ID, m *ChatMessage) error {
+	return cr.sendWithin(p, m, privateTimeout)
+}
+
+// sendWithin is sendTo, giving up on p after timeout
+func (cr *ChatRoom) sendWithin(p peer.ID, m *ChatMessage, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(cr.ctx, timeout)
+	defer cancel()
+	// a relayed connection will do, these are small
+	ctx = network.WithUseTransient(ctx, "private message")
+	s, err := cr.h.NewStream(ctx, p, privateProtocol(cr.roomName))
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	s.SetDeadline(time.Now().Add(timeout))
+
+	if err := json.NewEncoder(s).Encode(Envelope{Version: WireVersion, Message: m}); err != nil {
+		s.Reset()
+		return err
+	}
+	cr.stats.out.Add(1)
+	return s.CloseWrite()
+}
+
+// handlePrivate reads one private message and treats it like any other,
+// once we are sure it comes from the peer at the other end of the stream
+func (cr *ChatRoom) handlePrivate(s network.Stream) {
+	defer s.Close()
+	if !cr.track() {
+		s.Reset()
+		return
+	}
+	defer cr.wg.Done()
+
+	// the room's limits hold here as on the topic
+	from := s.Conn().RemotePeer()
+	if !cr.limiter.allow(from, time.Now()) {
+		s.Reset()
+		cr.emit(&Event{Type: EventRejected, Peer: from, Err: errTooFast})
+		return
+	}
+	s.SetDeadline(time.Now().Add(privateTimeout))
+	b, err := io.ReadAll(io.LimitReader(s, int64(cr.limits.MaxSize)+1))
+	if err == nil && len(b) > cr.limits.MaxSize {
+		err = fmt.Errorf("%w: over %d bytes", errTooBig, cr.limits.MaxSize)
+	}
+	env := new(Envelope)
+	if err == nil {
+		err = json.Unmarshal(b, env)
+	}
+	if err != nil {
+		s.Reset()
+		cr.emit(&Event{Type: EventRejected, Peer: from, Err: err})
+		return
+	}
+	cm, err := checkEnvelope(env, from)
+	if err != nil {
+		cr.emit(&Event{Type: EventRejected, Peer: from, Err: err})
+		return
+	}
+	if cm.To == "" {
+		cm.To = ShortID(cr.self) // so that it reads as private
+	}
+	cr.handle(cm)
+}
@@ -0,0 +1,175 @@
+package chat
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// DefaultCallTimeout bounds a Call whose context has no deadline of its own
+const DefaultCallTimeout = 10 * time.Second
+
+// Response is what one peer answered to a Call
+type Response struct {
+	From    peer.ID
+	Nick    string
+	Message string
+	Payload []byte
+}
+
+// CallError is a command that failed at the other end
+type CallError struct {
+	Peer peer.ID
+	Msg  string
+}
+
+func (e *CallError) Error() string {
+	return fmt.Sprintf("%s: %s", ShortID(e.Peer), e.Msg)
+}
+
+// pending is a call waiting for its replies
+type pending struct {
+	to      peer.ID // the one peer who may answer, empty for anyone
+	replies chan *ChatMessage
+}
+
+// Call runs the command method (with args) at peer p and waits for its
+// answer, at most until ctx is done or DefaultCallTimeout has passed.
+// The command goes to p alone, as a private message.
+func (cr *ChatRoom) Call(ctx context.Context, p peer.ID, method, args string) (*Response, error) {
+	if p == "" {
+		return nil, fmt.Errorf("chat: Call needs a peer, see CallAll")
+	}
+	ctx, cancel := withCallTimeout(ctx)
+	defer cancel()
+
+	id, pd := cr.newCall(p, 1)
+	defer cr.endCall(id)
+	if err := cr.sendTo(p, cr.callMessage(id, method, args)); err != nil {
+		return nil, err
+	}
+	select {
+	case cm := <-pd.replies:
+		return response(cm)
+	case <-ctx.Done():
+		return nil, fmt.Errorf("%s from %s: %w", method, ShortID(p), ctx.Err())
+	}
+}
+
+// CallAll asks everyone in the room to run method (with args). Answers
+// arrive on the channel as they come, until ctx is done or
+// DefaultCallTimeout has passed, when it is closed. Failures are reported
+// on Events, as a CallError.
+func (cr *ChatRoom) CallAll(ctx context.Context, method, args string) (<-chan *Response, error) {
+	if !cr.track() {
+		return nil, errClosed
+	}
+	ctx, leave := cr.withRoom(ctx) // the room may not wait for the answers
+	ctx, cancelCall := withCallTimeout(ctx)
+	cancel := func() { cancelCall(); leave() }
+
+	id, pd := cr.newCall("", ChatRoomBufSize)
+	msg, err := encodeMessage(cr.callMessage(id, method, args))
+	if err == nil {
+		cr.stats.out.Add(1)
+		err = cr.topic.Publish(cr.ctx, msg)
+	}
+	if err != nil {
+		cr.endCall(id)
+		cancel()
+		cr.wg.Done()
+		return nil, err
+	}
+
+	out := make(chan *Response)
+	go func() {
+		defer cr.wg.Done()
+		defer close(out)
+		defer cancel()
+		defer cr.endCall(id)
+		for {
+			select {
+			case cm := <-pd.replies:
+				resp, err := response(cm)
+				if err != nil {
+					cr.tryEmit(&Event{Type: EventError, Peer: senderID(cm), Text: method, Err: err})
+					continue
+				}
+				select {
+				case out <- resp:
+				case <-ctx.Done():
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out, nil
+}
+
+func withCallTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, DefaultCallTimeout)
+}
+
+// callMessage is the command line method args, tagged with the call's id
+func (cr *ChatRoom) callMessage(id, method, args string) *ChatMessage {
+	if !strings.HasPrefix(method, "/") {
+		method = "/" + method
+	}
+	return &ChatMessage{
+		Message:    strings.TrimSpace(method+" "+args) + "\n",
+		Call:       id,
+		SenderID:   cr.self.Pretty(),
+		SenderNick: cr.Nick(),
+	}
+}
+
+// newCall registers a call, expecting replies from `to` (anyone, if empty)
+func (cr *ChatRoom) newCall(to peer.ID, buf int) (string, *pending) {
+	b := make([]byte, 8)
+	rand.Read(b)
+	id := hex.EncodeToString(b)
+	pd := &pending{to: to, replies: make(chan *ChatMessage, buf)}
+	cr.callMu.Lock()
+	cr.calls[id] = pd
+	cr.callMu.Unlock()
+	return id, pd
+}
+
+func (cr *ChatRoom) endCall(id string) {
+	cr.callMu.Lock()
+	delete(cr.calls, id)
+	cr.callMu.Unlock()
+}
+
+// answer passes a reply to the call waiting for it. Replies nobody waits
+// for any more, or from peers who were not asked, are dropped.
+func (cr *ChatRoom) answer(cm *ChatMessage) {
+	cr.callMu.Lock()
+	pd, ok := cr.calls[cm.Reply]
+	cr.callMu.Unlock()
+	if !ok || (pd.to != "" && pd.to != senderID(cm)) {
+		return
+	}
+	select {
+	case pd.replies <- cm:
+	default: // the caller has all it can take
+	}
+}
+
+// response turns a reply into what Call returns
+func response(cm *ChatMessage) (*Response, error) {
+	if cm.Error != "" {
+		return nil, &CallError{Peer: senderID(cm), Msg: cm.Error}
+	}
+	return &Response{From: senderID(cm), Nick: cm.SenderNick, Message: cm.Message, Payload: cm.Payload}, nil
+}
@@ -0,0 +1,103 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCall(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	a, b := joinPair(t, ctx, "rpc")
+	b.commands = func(cm *ChatMessage) (string, []byte, error) {
+		cmd, args, _ := strings.Cut(strings.TrimSpace(cm.Message), " ")
+		switch cmd {
+		case "/echo":
+			return args, []byte(args), nil
+		case "/quiet":
+			return "", nil, nil
+		}
+		return "", nil, errors.New("no such command")
+	}
+
+	resp, err := a.Call(ctx, b.Self(), "/echo", "hi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Message != "hi" || string(resp.Payload) != "hi" || resp.From != b.Self() {
+		t.Errorf("got %q (%q) from %s, wanted %q from %s", resp.Message, resp.Payload, resp.From, "hi", b.Self())
+	}
+	// saying nothing is still an answer
+	if _, err := a.Call(ctx, b.Self(), "quiet", ""); err != nil {
+		t.Errorf("quiet call: %v", err)
+	}
+	var ce *CallError
+	if _, err := a.Call(ctx, b.Self(), "/nope", ""); !errors.As(err, &ce) || ce.Peer != b.Self() {
+		t.Errorf("failed call error = %v, wanted a CallError from %s", err, b.Self())
+	}
+	// a has no commands at all, and says so
+	if _, err := b.Call(ctx, a.Self(), "/echo", "hi"); !errors.As(err, &ce) {
+		t.Errorf("call to a = %v, wanted a CallError", err)
+	}
+	// no answer can beat a deadline that is already gone
+	short, stop := context.WithTimeout(ctx, time.Nanosecond)
+	defer stop()
+	<-short.Done()
+	if _, err := a.Call(short, b.Self(), "/echo", "late"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("late call error = %v, wanted a deadline", err)
+	}
+
+	// make sure the topic carries a's messages before asking everyone
+	resend(t, ctx, func() error { return a.Publish("hello\n", "", nil) })
+	select {
+	case <-b.Messages:
+	case <-ctx.Done():
+		t.Fatal("message never arrived")
+	}
+	all, stopAll := context.WithTimeout(ctx, 5*time.Second)
+	defer stopAll()
+	replies, err := a.CallAll(all, "/echo", "everyone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for resp := range replies {
+		n++
+		if resp.Message != "everyone" {
+			t.Errorf("got %q, wanted %q", resp.Message, "everyone")
+		}
+	}
+	if n != 1 {
+		t.Errorf("got %d answers, wanted 1", n)
+	}
+}
+
+func TestReplyLimit(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	a, b := joinPair(t, ctx, "replies")
+	b.commands = func(cm *ChatMessage) (string, []byte, error) { return "pong", nil, nil }
+	limits := Limits{MaxSize: 1, Rate: 0.01, Burst: 3} // nothing back for the test's length
+	b.replies = newRateLimiter(limits)
+
+	for i := 0; i < limits.Burst; i++ {
+		if _, err := a.Call(ctx, b.Self(), "/ping", ""); err != nil {
+			t.Fatalf("call %d: %v", i, err)
+		}
+	}
+	// b answers a no more for a while
+	short, stop := context.WithTimeout(ctx, 500*time.Millisecond)
+	defer stop()
+	if _, err := a.Call(short, b.Self(), "/ping", ""); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("call over the limit: error = %v, wanted no answer", err)
+	}
+
+	b.cancel()
+	<-b.done
+	if _, err := b.CallAll(ctx, "/ping", ""); !errors.Is(err, errClosed) {
+		t.Errorf("calling from a closed room: error = %v, wanted errClosed", err)
+	}
+}
@@ -0,0 +1,131 @@
+package chat
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+)
+
+// Stats are the running totals of a room, for metrics. They start from
+// zero each time the room is joined.
+type Stats struct {
+	MessagesIn  uint64 // messages that reached us, heartbeats included
+	MessagesOut uint64 // messages we sent, on the topic or in private
+	Rejected    uint64 // messages dropped as forged, unreadable, too big or too fast
+	Connected   uint64 // peers discovery connected us to
+	Unreachable uint64 // peers discovery found, but we could not connect to
+	Peers       int    // peers we share the topic with
+	Mesh        int    // of those, peers in our gossipsub mesh, see WithMesh
+}
+
+type roomStats struct {
+	in, out, rejected, connected, unreachable atomic.Uint64
+}
+
+// Stats tells how the room has been doing
+func (cr *ChatRoom) Stats() Stats {
+	st := Stats{
+		MessagesIn:  cr.stats.in.Load(),
+		MessagesOut: cr.stats.out.Load(),
+		Rejected:    cr.stats.rejected.Load(),
+		Connected:   cr.stats.connected.Load(),
+		Unreachable: cr.stats.unreachable.Load(),
+		Peers:       len(cr.ListPeers()),
+	}
+	if cr.mesh != nil {
+		st.Mesh = cr.mesh.Size(topicName(cr.roomName))
+	}
+	return st
+}
+
+// count keeps the totals that events tell of
+func (cr *ChatRoom) count(ev *Event) {
+	switch ev.Type {
+	case EventRejected:
+		cr.stats.rejected.Add(1)
+	case EventConnected:
+		cr.stats.connected.Add(1)
+	case EventConnectFailed:
+		cr.stats.unreachable.Add(1)
+	}
+}
+
+// Mesh follows which peers gossipsub has in its mesh for each topic, which
+// the pubsub API does not tell. Hand Option to NewGossipSub, and the Mesh
+// to the rooms with WithMesh.
+type Mesh struct {
+	mu     sync.Mutex
+	topics map[string]map[peer.ID]bool
+}
+
+// NewMesh returns a Mesh that knows of no topics yet
+func NewMesh() *Mesh {
+	return &Mesh{topics: make(map[string]map[peer.ID]bool)}
+}
+
+// Option has gossipsub report to the Mesh
+func (m *Mesh) Option() pubsub.Option {
+	return pubsub.WithRawTracer(m)
+}
+
+// WithMesh has the room's Stats include the size of its mesh
+func WithMesh(m *Mesh) Option {
+	return func(cr *ChatRoom) error {
+		cr.mesh = m
+		return nil
+	}
+}
+
+// Size is the number of peers in the mesh of topic
+func (m *Mesh) Size(topic string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.topics[topic])
+}
+
+func (m *Mesh) Graft(p peer.ID, topic string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.topics[topic] == nil {
+		m.topics[topic] = make(map[peer.ID]bool)
+	}
+	m.topics[topic][p] = true
+}
+
+func (m *Mesh) Prune(p peer.ID, topic string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.topics[topic], p)
+}
+
+func (m *Mesh) RemovePeer(p peer.ID) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, peers := range m.topics {
+		delete(peers, p)
+	}
+}
+
+func (m *Mesh) Leave(topic string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.topics, topic)
+}
+
+// the rest of pubsub.RawTracer is of no interest
+
+func (m *Mesh) AddPeer(p peer.ID, proto protocol.ID)        {}
+func (m *Mesh) Join(topic string)                           {}
+func (m *Mesh) ValidateMessage(msg *pubsub.Message)         {}
+func (m *Mesh) DeliverMessage(msg *pubsub.Message)          {}
+func (m *Mesh) RejectMessage(msg *pubsub.Message, r string) {}
+func (m *Mesh) DuplicateMessage(msg *pubsub.Message)        {}
+func (m *Mesh) ThrottlePeer(p peer.ID)                      {}
+func (m *Mesh) RecvRPC(rpc *pubsub.RPC)                     {}
+func (m *Mesh) SendRPC(rpc *pubsub.RPC, p peer.ID)          {}
+func (m *Mesh) DropRPC(rpc *pubsub.RPC, p peer.ID)          {}
+func (m *Mesh) UndeliverableMessage(msg *pubsub.Message)    {}
@@ -0,0 +1,37 @@
+package chat
+
+import (
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/test"
+)
+
+func TestMesh(t *testing.T) {
+	a, b := test.RandPeerIDFatal(t), test.RandPeerIDFatal(t)
+	m := NewMesh()
+	m.Graft(a, "one")
+	m.Graft(b, "one")
+	m.Graft(a, "two")
+	if m.Size("one") != 2 || m.Size("two") != 1 {
+		t.Fatalf("sizes %d %d, want 2 1", m.Size("one"), m.Size("two"))
+	}
+	m.Prune(b, "one")
+	m.RemovePeer(a)
+	if m.Size("one") != 0 || m.Size("two") != 0 {
+		t.Errorf("sizes %d %d, want 0 0", m.Size("one"), m.Size("two"))
+	}
+	m.Leave("one")
+	if m.Size("one") != 0 {
+		t.Error("left, still there")
+	}
+}
+
+func TestCount(t *testing.T) {
+	cr := &ChatRoom{}
+	for _, typ := range []EventType{EventRejected, EventRejected, EventConnected, EventConnectFailed, EventJoin} {
+		cr.count(&Event{Type: typ})
+	}
+	if cr.stats.rejected.Load() != 2 || cr.stats.connected.Load() != 1 || cr.stats.unreachable.Load() != 1 {
+		t.Errorf("got %d rejected, %d connected, %d unreachable", cr.stats.rejected.Load(), cr.stats.connected.Load(), cr.stats.unreachable.Load())
+	}
+}
@@ -0,0 +1,429 @@
+package chat
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// TransferProtocol carries files from one peer to another. The sender
+// offers a file, name, size and sha256; once the receiver accepts, it says
+// how much it already has (from an earlier, broken, transfer) and the
+// sender sends the rest. The receiver checks the hash before keeping it.
+const TransferProtocol = "/chat/file/1.0.0"
+
+const (
+	// ChunkSize is how much of a file goes over between progress reports
+	ChunkSize = 64 << 10
+	// offerTimeout is how long an offer waits for /accept
+	offerTimeout = 5 * time.Minute
+	// DefaultMaxDownload is the largest file we are offered, unless
+	// WithMaxDownload says otherwise
+	DefaultMaxDownload = 1 << 30
+)
+
+// offerSeq numbers the offers, in all rooms, so that IDs are ours to pick
+var offerSeq atomic.Int64
+
+var (
+	// ErrRefused means the receiver turned our file down
+	ErrRefused = errors.New("chat: file refused")
+	// ErrNoOffer means there is no offer by that ID
+	ErrNoOffer     = errors.New("chat: no such offer")
+	errNoDownloads = errors.New("not taking files")
+	errMaxDownload = errors.New("chat: max download must be positive")
+)
+
+// Offer is a file another peer wants to send us
+type Offer struct {
+	ID   string // ours, not the sender's
+	Peer peer.ID
+	Nick string
+	Room string
+	Name string
+	Size int64
+	Hash string // sha256, hex
+
+	seq    int64
+	decide chan bool
+}
+
+func (o *Offer) String() string {
+	return fmt.Sprintf("%s %s (%d bytes) from %s~%s", o.ID, o.Name, o.Size, o.Nick, ShortID(o.Peer))
+}
+
+// offerMsg, answerMsg and resultMsg are the lines of JSON the two ends exchange
+type offerMsg struct {
+	Name string
+	Size int64
+	Hash string
+	Nick string
+}
+
+type answerMsg struct {
+	Accept bool
+	Offset int64  // what we have already
+	Err    string `json:",omitempty"`
+}
+
+type resultMsg struct {
+	Err string `json:",omitempty"`
+}
+
+// transferProtocol is per room, like privateProtocol
+func transferProtocol(roomName string) protocol.ID {
+	return protocol.ID(TransferProtocol + "/" + roomName)
+}
+
+// WithDownloads takes files sent to us, once accepted, into dir.
+// Without it, every offer is refused.
+func WithDownloads(dir string) Option {
+	return func(cr *ChatRoom) error {
+		cr.downloads = dir
+		return nil
+	}
+}
+
+// WithMaxDownload turns down files over max bytes, DefaultMaxDownload otherwise
+func WithMaxDownload(max int64) Option {
+	return func(cr *ChatRoom) error {
+		if max <= 0 {
+			return errMaxDownload
+		}
+		cr.maxDownload = max
+		return nil
+	}
+}
+
+// SendFile offers the file at path to peer p, and sends it if p accepts.
+// It returns once p has the file, checked, or turned it down (ErrRefused).
+// Sending the same file again picks up where a broken transfer stopped,
+// as it does when the room closes halfway.
+func (cr *ChatRoom) SendFile(ctx context.Context, p peer.ID, path string) error {
+	if !cr.track() {
+		return errClosed
+	}
+	defer cr.wg.Done()
+	ctx, cancel := cr.withRoom(ctx)
+	defer cancel()
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	hash, size, err := hashFile(f)
+	if err != nil {
+		return err
+	}
+	name := filepath.Base(path)
+
+	// relayed connections will do, if slowly: a cut is resumed next time
+	ctx = network.WithUseTransient(ctx, "file transfer")
+	s, err := cr.h.NewStream(ctx, p, transferProtocol(cr.roomName))
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	stop := resetOnDone(ctx, s)
+	defer stop()
+
+	r := bufio.NewReader(s)
+	if err := writeLine(s, offerMsg{Name: name, Size: size, Hash: hash, Nick: cr.Nick()}); err != nil {
+		s.Reset()
+		return err
+	}
+	var ans answerMsg
+	if err := readLine(r, &ans); err != nil {
+		return err
+	}
+	if !ans.Accept {
+		if ans.Err != "" {
+			return fmt.Errorf("%w: %s", ErrRefused, ans.Err)
+		}
+		return ErrRefused
+	}
+	if ans.Offset < 0 || ans.Offset > size {
+		s.Reset()
+		return fmt.Errorf("chat: %s wants %s from byte %d", ShortID(p), name, ans.Offset)
+	}
+	if _, err := f.Seek(ans.Offset, io.SeekStart); err != nil {
+		s.Reset()
+		return err
+	}
+	progress := cr.progress(p, "sending "+name, size)
+	for done := ans.Offset; done < size; {
+		n, err := io.CopyN(s, f, min64(ChunkSize, size-done))
+		done += n
+		if err != nil {
+			s.Reset()
+			return err
+		}
+		progress(done)
+	}
+	if err := s.CloseWrite(); err != nil {
+		return err
+	}
+	var res resultMsg
+	if err := readLine(r, &res); err != nil {
+		return err
+	}
+	if res.Err != "" {
+		return fmt.Errorf("chat: %s: %s", ShortID(p), res.Err)
+	}
+	return nil
+}
+
+// Offers lists the files waiting for Accept or Refuse
+func (cr *ChatRoom) Offers() []*Offer {
+	cr.offerMu.Lock()
+	defer cr.offerMu.Unlock()
+	var offers []*Offer
+	for _, o := range cr.offers {
+		offers = append(offers, o)
+	}
+	sort.Slice(offers, func(i, j int) bool { return offers[i].seq < offers[j].seq })
+	return offers
+}
+
+// Accept takes the file offered as id
+func (cr *ChatRoom) Accept(id string) error {
+	return cr.decide(id, true)
+}
+
+// Refuse turns the file offered as id down
+func (cr *ChatRoom) Refuse(id string) error {
+	return cr.decide(id, false)
+}
+
+func (cr *ChatRoom) decide(id string, accept bool) error {
+	cr.offerMu.Lock()
+	o, ok := cr.offers[id]
+	delete(cr.offers, id)
+	cr.offerMu.Unlock()
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrNoOffer, id)
+	}
+	o.decide <- accept // buffered, and only ever sent once
+	return nil
+}
+
+// handleTransfer takes an offer, waits for it to be accepted, and receives the file
+func (cr *ChatRoom) handleTransfer(s network.Stream) {
+	defer s.Close()
+	if !cr.track() {
+		s.Reset()
+		return
+	}
+	defer cr.wg.Done()
+	stop := resetOnDone(cr.ctx, s)
+	defer stop()
+
+	from := s.Conn().RemotePeer()
+	r := bufio.NewReader(s)
+	var om offerMsg
+	if err := readLine(r, &om); err != nil {
+		cr.emit(&Event{Type: EventRejected, Peer: from, Err: err})
+		return
+	}
+	name := filepath.Base(om.Name)
+	if _, err := hex.DecodeString(om.Hash); err != nil || len(om.Hash) != sha256.Size*2 {
+		writeLine(s, answerMsg{Err: "bad hash"})
+		return
+	}
+	if cr.downloads == "" || om.Size < 0 || name == "." || name == ".." || name == string(filepath.Separator) {
+		writeLine(s, answerMsg{Err: errNoDownloads.Error()})
+		return
+	}
+	if om.Size > cr.maxDownload {
+		writeLine(s, answerMsg{Err: fmt.Sprintf("too big, we take up to %d bytes", cr.maxDownload)})
+		return
+	}
+
+	om.Hash = strings.ToLower(om.Hash)
+	seq := offerSeq.Add(1)
+	o := &Offer{
+		ID:     fmt.Sprint(seq),
+		Peer:   from,
+		Nick:   om.Nick,
+		Room:   cr.roomName,
+		Name:   name,
+		Size:   om.Size,
+		Hash:   om.Hash,
+		seq:    seq,
+		decide: make(chan bool, 1),
+	}
+	cr.offerMu.Lock()
+	for _, other := range cr.offers {
+		if other.Hash == o.Hash { // the same .part file
+			cr.offerMu.Unlock()
+			writeLine(s, answerMsg{Err: "already offered"})
+			return
+		}
+	}
+	cr.offers[o.ID] = o
+	cr.offerMu.Unlock()
+	cr.emit(&Event{Type: EventOffer, Peer: from, Text: o.String()})
+
+	accept := false
+	select {
+	case accept = <-o.decide:
+	case <-time.After(offerTimeout):
+		cr.decide(o.ID, false)
+	case <-cr.ctx.Done():
+		cr.decide(o.ID, false)
+	}
+	if !accept {
+		writeLine(s, answerMsg{})
+		return
+	}
+
+	path, err := cr.receive(s, r, o)
+	if err != nil {
+		writeLine(s, resultMsg{Err: err.Error()})
+		cr.emit(&Event{Type: EventError, Peer: from, Text: "receiving " + o.Name, Err: err})
+		return
+	}
+	writeLine(s, resultMsg{})
+	cr.deliverData(&ChatData{File: path, SenderID: from.Pretty(), SenderNick: o.Nick, Room: cr.roomName})
+}
+
+// receive reads o into a partial file, named for its hash so that a broken
+// transfer can be resumed, and moves it to the downloads once it checks out
+func (cr *ChatRoom) receive(s network.Stream, r *bufio.Reader, o *Offer) (string, error) {
+	if err := os.MkdirAll(cr.downloads, 0700); err != nil {
+		writeLine(s, answerMsg{Err: "cannot store it"})
+		return "", err
+	}
+	part := filepath.Join(cr.downloads, "."+o.Hash+".part")
+	f, err := os.OpenFile(part, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		writeLine(s, answerMsg{Err: "cannot store it"})
+		return "", err
+	}
+	defer f.Close()
+	have, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return "", err
+	}
+	if have > o.Size {
+		if err := f.Truncate(0); err != nil {
+			return "", err
+		}
+		have, _ = f.Seek(0, io.SeekStart)
+	}
+	if err := writeLine(s, answerMsg{Accept: true, Offset: have}); err != nil {
+		return "", err
+	}
+
+	progress := cr.progress(o.Peer, "receiving "+o.Name, o.Size)
+	for have < o.Size {
+		s.SetReadDeadline(time.Now().Add(privateTimeout))
+		n, err := io.CopyN(f, r, min64(ChunkSize, o.Size-have))
+		have += n
+		if err != nil {
+			return "", err // what we have is kept, for next time
+		}
+		progress(have)
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	hash, _, err := hashFile(f)
+	if err != nil {
+		return "", err
+	}
+	if hash != o.Hash {
+		os.Remove(part)
+		return "", errors.New("hash does not match, file dropped")
+	}
+	f.Close() // before it moves
+	path := freeName(filepath.Join(cr.downloads, o.Name))
+	return path, os.Rename(part, path)
+}
+
+// progress returns a func reporting, every 10%, how far along name is
+func (cr *ChatRoom) progress(p peer.ID, name string, size int64) func(done int64) {
+	last := int64(-1)
+	return func(done int64) {
+		pct := int64(100)
+		if size > 0 {
+			pct = done * 100 / size
+		}
+		if pct/10 == last/10 && pct < 100 || cr.ctx.Err() != nil {
+			return
+		}
+		last = pct
+		cr.tryEmit(&Event{Type: EventProgress, Peer: p, Text: fmt.Sprintf("%s %d%%", name, pct)})
+	}
+}
+
+// freeName is path, or path with a number added if that is taken
+func freeName(path string) string {
+	ext := filepath.Ext(path)
+	base := strings.TrimSuffix(path, ext)
+	for i := 1; ; i++ {
+		if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+			return path
+		}
+		path = fmt.Sprintf("%s-%d%s", base, i, ext)
+	}
+}
+
+// hashFile reads f to the end, for its sha256 and size
+func hashFile(f io.Reader) (string, int64, error) {
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), n, nil
+}
+
+// resetOnDone resets s when ctx is done, until stop is called
+func resetOnDone(ctx context.Context, s network.Stream) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.Reset()
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
+
+func writeLine(w io.Writer, v any) error {
+	return json.NewEncoder(w).Encode(v)
+}
+
+func readLine(r *bufio.Reader, v any) error {
+	line, err := r.ReadSlice('\n') // no line of ours fills the buffer
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(line, v)
+}
+
+func min64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
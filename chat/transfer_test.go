@@ -0,0 +1,157 @@
+package chat
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSendFile(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	a, b := joinPair(t, ctx, "files")
+	b.downloads = t.TempDir()
+
+	content := bytes.Repeat([]byte("0123456789"), ChunkSize/4) // a few chunks
+	path := filepath.Join(t.TempDir(), "digits.txt")
+	if err := os.WriteFile(path, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	// half of it came over before, and was kept
+	sum := sha256.Sum256(content)
+	part := filepath.Join(b.downloads, "."+hex.EncodeToString(sum[:])+".part")
+	if err := os.WriteFile(part, content[:len(content)/2], 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// offer waits for b to decide
+	send := func() chan error {
+		sent := make(chan error, 1)
+		go func() { sent <- a.SendFile(ctx, b.Self(), path) }()
+		for {
+			select {
+			case ev := <-b.Events:
+				if ev.Type != EventOffer {
+					continue
+				}
+				if offers := b.Offers(); len(offers) != 1 || offers[0].Name != "digits.txt" {
+					t.Fatalf("offers = %v, wanted digits.txt", offers)
+				}
+				return sent
+			case <-ctx.Done():
+				t.Fatal("no offer")
+			}
+		}
+	}
+
+	sent := send()
+	if err := b.Refuse(b.Offers()[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-sent; !errors.Is(err, ErrRefused) {
+		t.Errorf("refused file: error = %v, wanted ErrRefused", err)
+	}
+
+	sent = send()
+	if err := b.Accept(b.Offers()[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-sent; err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case data := <-b.Data:
+		got, err := os.ReadFile(data.File)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, content) || filepath.Base(data.File) != "digits.txt" {
+			t.Errorf("got %d bytes in %s, wanted %d in digits.txt", len(got), data.File, len(content))
+		}
+	case <-ctx.Done():
+		t.Fatal("file never arrived")
+	}
+	if _, err := os.Stat(part); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("partial file left behind: %v", err)
+	}
+}
+
+func TestOfferLimits(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	roomCtx, leave := context.WithCancel(ctx)
+	a, b := joinPair(t, roomCtx, "offers")
+	b.downloads = t.TempDir()
+	b.maxDownload = 10
+
+	path := filepath.Join(t.TempDir(), "big.txt")
+	if err := os.WriteFile(path, []byte("more than ten bytes"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.SendFile(ctx, b.Self(), path); !errors.Is(err, ErrRefused) {
+		t.Errorf("file over the limit: error = %v, wanted ErrRefused", err)
+	}
+	if parts, _ := filepath.Glob(filepath.Join(b.downloads, "*.part")); len(parts) != 0 || len(b.Offers()) != 0 {
+		t.Errorf("file over the limit offered, or stored: %v", parts)
+	}
+
+	// an offer goes with the room
+	b.maxDownload = DefaultMaxDownload
+	go a.SendFile(ctx, b.Self(), path)
+	for len(b.Offers()) == 0 {
+		select {
+		case <-ctx.Done():
+			t.Fatal("no offer")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	if id := b.Offers()[0].ID; len(id) == 0 || len(id) >= 8 {
+		t.Errorf("offer ID %q is not ours", id)
+	}
+	leave()
+	<-b.done
+	if offers := b.Offers(); len(offers) != 0 {
+		t.Errorf("offers left after the room closed: %v", offers)
+	}
+}
+
+func TestSendFileLeave(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	a, b := joinPair(t, ctx, "leaving")
+	b.downloads = t.TempDir()
+	path := filepath.Join(t.TempDir(), "small.txt")
+	if err := os.WriteFile(path, []byte("small"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// the sender leaves while the offer waits: its room takes the transfer down
+	sent := make(chan error, 1)
+	go func() { sent <- a.SendFile(context.Background(), b.Self(), path) }()
+	for len(b.Offers()) == 0 {
+		select {
+		case <-ctx.Done():
+			t.Fatal("no offer")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	a.cancel()
+	select {
+	case err := <-sent:
+		if err == nil {
+			t.Error("sent a file from a room we left")
+		}
+	case <-ctx.Done():
+		t.Fatal("still sending after we left")
+	}
+	<-a.done
+	if err := a.SendFile(ctx, b.Self(), path); !errors.Is(err, errClosed) {
+		t.Errorf("sending from a closed room: error = %v, wanted errClosed", err)
+	}
+}
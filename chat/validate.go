@@ -0,0 +1,180 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+)
+
+// Limits bound what a room accepts from each peer, on the topic and over
+// private streams alike. Messages beyond them are dropped before gossipsub
+// passes them on, and count against the score of the peer who delivered
+// them: for a flood, only if that peer wrote them too, as whoever relays
+// one need not have started it.
+type Limits struct {
+	MaxSize int     // bytes of a message as it goes over the wire
+	Rate    float64 // messages a second, kept up over time
+	Burst   int     // messages in one go
+}
+
+// DefaultLimits are plenty for people typing
+var DefaultLimits = Limits{MaxSize: 64 << 10, Rate: 5, Burst: 20}
+
+var (
+	errTooBig      = errors.New("chat: message too big")
+	errTooFast     = errors.New("chat: sending too fast")
+	errPublicTo    = errors.New("chat: private message on the topic")
+	errLimitValues = errors.New("chat: limits must be positive")
+)
+
+// WithLimits sets the Limits of the room, DefaultLimits otherwise
+func WithLimits(l Limits) Option {
+	return func(cr *ChatRoom) error {
+		if l.MaxSize <= 0 || l.Rate <= 0 || l.Burst <= 0 {
+			return errLimitValues
+		}
+		cr.limits = l
+		return nil
+	}
+}
+
+// NewGossipSub starts gossipsub on h with peer scoring on, so that peers
+// whose messages our rooms reject are pushed out of the mesh and, if they
+// keep at it, ignored.
+func NewGossipSub(ctx context.Context, h host.Host, opts ...pubsub.Option) (*pubsub.PubSub, error) {
+	opts = append([]pubsub.Option{pubsub.WithPeerScore(peerScoreParams(), peerScoreThresholds())}, opts...)
+	return pubsub.NewGossipSub(ctx, h, opts...)
+}
+
+func peerScoreParams() *pubsub.PeerScoreParams {
+	return &pubsub.PeerScoreParams{
+		Topics:           make(map[string]*pubsub.TopicScoreParams),
+		AppSpecificScore: func(peer.ID) float64 { return 0 },
+		DecayInterval:    time.Second,
+		DecayToZero:      0.01,
+		RetainScore:      time.Hour,
+	}
+}
+
+// peerScoreThresholds: a handful of rejected messages stops our gossip to a
+// peer, a few more and we ignore it altogether
+func peerScoreThresholds() *pubsub.PeerScoreThresholds {
+	return &pubsub.PeerScoreThresholds{
+		GossipThreshold:   -500,
+		PublishThreshold:  -1000,
+		GraylistThreshold: -2500,
+	}
+}
+
+// topicScoreParams only punish: a rejected message costs its deliverer
+// 100 times the square of its count, forgotten over about an hour
+func topicScoreParams() *pubsub.TopicScoreParams {
+	return &pubsub.TopicScoreParams{
+		SkipAtomicValidation:           true,
+		TopicWeight:                    1,
+		TimeInMeshQuantum:              time.Second, // unused, but divided by
+		InvalidMessageDeliveriesWeight: -100,
+		InvalidMessageDeliveriesDecay:  pubsub.ScoreParameterDecay(time.Hour),
+	}
+}
+
+// validate is the room's topic validator: only well formed, signed, modest
+// messages get through, at a modest rate. The decoded message is left in
+// ValidatorData for readLoop.
+func (cr *ChatRoom) validate(ctx context.Context, from peer.ID, msg *pubsub.Message) pubsub.ValidationResult {
+	err := cr.check(msg)
+	if err != nil {
+		cr.tryEmit(&Event{Type: EventRejected, Peer: msg.GetFrom(), Err: err})
+	}
+	return verdict(err, msg.ReceivedFrom != msg.GetFrom())
+}
+
+// verdict: malformed and forged messages are rejected, and cost the peer
+// who passed them on. So do those over the rate, from their author; passed
+// on by somebody else, they are only ignored.
+func verdict(err error, forwarded bool) pubsub.ValidationResult {
+	switch {
+	case err == nil:
+		return pubsub.ValidationAccept
+	case errors.Is(err, errTooFast) && forwarded:
+		return pubsub.ValidationIgnore
+	}
+	return pubsub.ValidationReject
+}
+
+func (cr *ChatRoom) check(msg *pubsub.Message) error {
+	if len(msg.Data) > cr.limits.MaxSize {
+		return fmt.Errorf("%w: %d bytes", errTooBig, len(msg.Data))
+	}
+	cm, err := decodeMessage(msg)
+	if err != nil {
+		return err
+	}
+	if cm.To != "" {
+		return errPublicTo
+	}
+	if msg.GetFrom() != cr.self && !cr.limiter.allow(msg.GetFrom(), time.Now()) {
+		return errTooFast
+	}
+	msg.ValidatorData = cm
+	return nil
+}
+
+// rateLimiter is a token bucket per peer
+type rateLimiter struct {
+	rate  float64
+	burst float64
+
+	mu    sync.Mutex
+	peers map[peer.ID]*bucket
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(l Limits) *rateLimiter {
+	return &rateLimiter{rate: l.Rate, burst: float64(l.Burst), peers: make(map[peer.ID]*bucket)}
+}
+
+// allow takes a token from p's bucket, if there is one
+func (rl *rateLimiter) allow(p peer.ID, now time.Time) bool {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	b, ok := rl.peers[p]
+	if !ok {
+		if len(rl.peers) > 1024 {
+			rl.prune(now)
+		}
+		b = &bucket{tokens: rl.burst, last: now}
+		rl.peers[p] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * rl.rate
+	if b.tokens > rl.burst {
+		b.tokens = rl.burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// prune forgets the buckets that have filled up again
+func (rl *rateLimiter) prune(now time.Time) {
+	full := time.Duration(rl.burst / rl.rate * float64(time.Second))
+	for p, b := range rl.peers {
+		if now.Sub(b.last) > full {
+			delete(rl.peers, p)
+		}
+	}
+}
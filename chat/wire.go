@@ -0,0 +1,70 @@
+package chat
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+)
+
+// WireVersion is the version of the Envelope we publish, and the only one we read
+const WireVersion = 1
+
+var (
+	// ErrUnsigned means a message came without a pubsub signature, so we
+	// cannot tell who wrote it
+	ErrUnsigned = errors.New("chat: unsigned message")
+	// ErrImpersonation means the claimed sender is not the peer who signed
+	ErrImpersonation = errors.New("chat: sender does not match signer")
+)
+
+// Envelope is what actually goes over the wire: a ChatMessage with a version
+type Envelope struct {
+	Version int          `json:"v"`
+	Message *ChatMessage `json:"m"`
+}
+
+// encodeMessage wraps cm in the current Envelope
+func encodeMessage(cm *ChatMessage) ([]byte, error) {
+	return json.Marshal(Envelope{Version: WireVersion, Message: cm})
+}
+
+// decodeMessage unwraps a pubsub message, checking that its SenderID is the
+// peer that signed it. Gossipsub has already verified the signature against
+// From (our rooms use the default StrictSign policy), so a matching SenderID
+// is as good as the signature.
+func decodeMessage(msg *pubsub.Message) (*ChatMessage, error) {
+	if msg.GetSignature() == nil || msg.GetFrom() == "" {
+		return nil, ErrUnsigned
+	}
+	env := new(Envelope)
+	if err := json.Unmarshal(msg.Data, env); err != nil {
+		return nil, err
+	}
+	return checkEnvelope(env, msg.GetFrom())
+}
+
+// checkEnvelope makes sure env is one we read, sent by `from`
+func checkEnvelope(env *Envelope, from peer.ID) (*ChatMessage, error) {
+	if env.Version != WireVersion {
+		return nil, fmt.Errorf("chat: wire version %d not supported", env.Version)
+	}
+	if env.Message == nil {
+		return nil, errors.New("chat: empty envelope")
+	}
+	cm := env.Message
+	claimed, err := peer.Decode(cm.SenderID)
+	if err != nil || claimed != from {
+		return nil, ErrImpersonation
+	}
+	return cm, nil
+}
+
+// From is how a sender is shown: the nick they chose, tied to the
+// (verified) short ID, so that nobody can pass for somebody else
+func (cm *ChatMessage) From() string {
+	return fmt.Sprintf("%s~%s", cm.SenderNick, cm.Sender())
+}
@@ -7,7 +7,10 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"syscall"
 
+	"github.com/bpc2016/p2p/identity"
 	"github.com/libp2p/go-libp2p"
 	"github.com/libp2p/go-libp2p/core/host"
 	"github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/client"
@@ -35,7 +38,15 @@ func getHostAddress(ha host.Host) string {
 }
 
 func main() {
-	ctx, cancel := context.WithCancel(context.Background())
+	if len(os.Args) > 1 && os.Args[1] == "identity" {
+		if err := identity.Command(os.Args[0], os.Args[2:], os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// ^C or SIGTERM end the chat
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer cancel()
 
 	// LibP2P code uses golog to log messages. They log with different
@@ -46,14 +57,21 @@ func main() {
 	// flags
 	relayF := flag.String("r", "", "relay host full address")
 	targetF := flag.String("t", "", "target (receiver) host full address")
+	keyF := flag.String("key", "", "file keeping our identity, created if missing; empty for a new one each run")
 	flag.Parse()
 
 	if *relayF == "" {
 		log.Fatalf("use -r to set relay host full address")
 	}
 
+	id, err := identity.Option(*keyF)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	// define a host that is unreachable
 	hs, err := libp2p.New(
+		id,
 		libp2p.NoListenAddrs,
 		// Usually EnableRelay() is not required as it is enabled by default
 		// but NoListenAddrs overrides this, so we're adding it in explictly again.
@@ -73,22 +91,26 @@ func main() {
 		return
 	}
 
-	if err := hs.Connect(context.Background(), *relayinfo); err != nil {
+	defer hs.Close()
+
+	if err := hs.Connect(ctx, *relayinfo); err != nil {
 		log.Printf("Failed to connect receiver and relayhost: %v", err)
 		return
 	}
 
 	if *targetF == "" { // we are a receiver
-		doReceiver(hs, relayinfo)
+		doReceiver(ctx, hs, relayinfo)
 	} else {
-		doSender(hs, relayinfo, *targetF)
+		doSender(ctx, hs, relayinfo, *targetF)
 	}
 	// wait for connections, close with ^C
 	<-ctx.Done()
+	cancel() // a second ^C kills us
+	log.Println("closing")
 }
 
 // setup a receiver host ( no -m flag)
-func doReceiver(receiver host.Host, relayinfo *peer.AddrInfo) {
+func doReceiver(ctx context.Context, receiver host.Host, relayinfo *peer.AddrInfo) {
 	// set up a protocol handler on receiver
 	receiver.SetStreamHandler("/chat/1.0.0", func(s network.Stream) {
 		log.Println("Awesome! We're now communicating via the relay!")
@@ -104,7 +126,7 @@ func doReceiver(receiver host.Host, relayinfo *peer.AddrInfo) {
 	// with the circuit relay service host
 	// As we will open a stream to receiver, receiver needs to make the
 	// reservation
-	_, err := client.Reserve(context.Background(), receiver, *relayinfo)
+	_, err := client.Reserve(ctx, receiver, *relayinfo)
 	if err != nil {
 		log.Printf("receiver failed to obtain a relay reservation from relayhost. %v", err)
 		return
@@ -112,7 +134,7 @@ func doReceiver(receiver host.Host, relayinfo *peer.AddrInfo) {
 }
 
 // setup a sender host
-func doSender(sender host.Host, relayinfo *peer.AddrInfo, fullLAddr string) {
+func doSender(ctx context.Context, sender host.Host, relayinfo *peer.AddrInfo, fullLAddr string) {
 	// Now create a new address for receiver that specifies to communicate via
 	// relayhost using a circuit relay
 	relayaddr, err := ma.NewMultiaddr("/p2p/" + relayinfo.ID.String() + "/p2p-circuit" + fullLAddr)
@@ -138,7 +160,7 @@ func doSender(sender host.Host, relayinfo *peer.AddrInfo, fullLAddr string) {
 	}
 
 	// here the sender connects to listerner
-	if err := sender.Connect(context.Background(), receiverrelayinfo); err != nil {
+	if err := sender.Connect(ctx, receiverrelayinfo); err != nil {
 		log.Printf("Unexpected error here. Failed to connect sender and receiver: %v", err)
 		return
 	}
@@ -149,8 +171,9 @@ func doSender(sender host.Host, relayinfo *peer.AddrInfo, fullLAddr string) {
 	// relayed connection. In general, we should only do this if we have low bandwidth requirements,
 	// and we're happy for the connection to be killed when the relayed connection is replaced with a
 	// direct (holepunched) connection.
-	// remove the transient feture: we now changed the server
-	s, err := sender.NewStream(context.Background(), receiverID, "/chat/1.0.0")
+	// A relay without limits (the default) hands out circuits that are not
+	// transient, but one run with -limits public or private does not.
+	s, err := sender.NewStream(network.WithUseTransient(ctx, "relay chat"), receiverID, "/chat/1.0.0")
 	if err != nil {
 		log.Println("Whoops, this should have worked...: ", err)
 		return
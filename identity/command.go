@@ -0,0 +1,85 @@
+package identity
+
+import (
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"io"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// Usage is how the identity subcommand is used
+const Usage = `usage: %s identity <generate|inspect|export> [-key file]
+
+  generate  make a new key in file (encrypted if $` + PassphraseEnv + ` is set)
+  inspect   show the peer ID, key type, and whether the file is encrypted
+  export    print the key, unencrypted, base64 as in an IPFS config; -public for the public key
+`
+
+// Command runs the identity subcommand of program with args (what follows
+// "identity" on the command line), writing to out
+func Command(program string, args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return fmt.Errorf(Usage, program)
+	}
+	fs := flag.NewFlagSet(program+" identity "+args[0], flag.ContinueOnError)
+	fs.SetOutput(out)
+	keyF := fs.String("key", "identity.key", "key file")
+	publicF := fs.Bool("public", false, "export the public key only")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "generate":
+		key, err := Generate()
+		if err != nil {
+			return err
+		}
+		if err := Save(*keyF, key, Passphrase()); err != nil {
+			return err
+		}
+		return inspect(out, *keyF, key)
+	case "inspect":
+		key, err := Load(*keyF, Passphrase())
+		if err != nil {
+			return err
+		}
+		return inspect(out, *keyF, key)
+	case "export":
+		key, err := Load(*keyF, Passphrase())
+		if err != nil {
+			return err
+		}
+		var raw []byte
+		if *publicF {
+			raw, err = crypto.MarshalPublicKey(key.GetPublic())
+		} else {
+			raw, err = crypto.MarshalPrivateKey(key)
+		}
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(out, base64.StdEncoding.EncodeToString(raw))
+		return err
+	}
+	return fmt.Errorf(Usage, program)
+}
+
+func inspect(out io.Writer, path string, key crypto.PrivKey) error {
+	id, err := peer.IDFromPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	encrypted := len(Passphrase()) > 0
+	if _, err := Load(path, nil); err == nil {
+		encrypted = false
+	}
+	fmt.Fprintf(out, "file:      %s\n", path)
+	fmt.Fprintf(out, "peer ID:   %s\n", id)
+	fmt.Fprintf(out, "key type:  %s\n", key.Type())
+	fmt.Fprintf(out, "encrypted: %v\n", encrypted)
+	return nil
+}
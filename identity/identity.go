@@ -0,0 +1,197 @@
+// Package identity keeps a host's private key in a file, so that the host
+// has the same peer ID from one run to the next. The key can be encrypted
+// with a passphrase.
+package identity
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"golang.org/x/crypto/scrypt"
+)
+
+// PassphraseEnv names the environment variable the passphrase is read
+// from, see Passphrase
+const PassphraseEnv = "P2P_KEY_PASSPHRASE"
+
+const (
+	plainBlock     = "LIBP2P PRIVATE KEY"
+	encryptedBlock = "ENCRYPTED LIBP2P PRIVATE KEY"
+)
+
+var (
+	// ErrPassphrase means the key file is encrypted, and we have the wrong
+	// passphrase for it (or none)
+	ErrPassphrase = errors.New("identity: wrong or missing passphrase, see " + PassphraseEnv)
+	errNotKey     = errors.New("identity: not a key file")
+)
+
+// Passphrase is the passphrase from the environment, nil if there is none
+func Passphrase() []byte {
+	if s := os.Getenv(PassphraseEnv); s != "" {
+		return []byte(s)
+	}
+	return nil
+}
+
+// Generate makes a new Ed25519 key
+func Generate() (crypto.PrivKey, error) {
+	priv, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	return priv, err
+}
+
+// Load reads the key kept at path. An encrypted key needs its passphrase.
+func Load(path string, passphrase []byte) (crypto.PrivKey, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("%s: %w", path, errNotKey)
+	}
+	raw := block.Bytes
+	switch block.Type {
+	case plainBlock:
+	case encryptedBlock:
+		if raw, err = decrypt(block, passphrase); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("%s: %w", path, errNotKey)
+	}
+	return crypto.UnmarshalPrivateKey(raw)
+}
+
+// Save writes key to path, encrypted if there is a passphrase. It will not
+// overwrite a key that is there already.
+func Save(path string, key crypto.PrivKey, passphrase []byte) error {
+	raw, err := crypto.MarshalPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	block := &pem.Block{Type: plainBlock, Bytes: raw}
+	if len(passphrase) > 0 {
+		if block, err = encrypt(raw, passphrase); err != nil {
+			return err
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if err := pem.Encode(f, block); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// LoadOrCreate loads the key at path, making (and saving) a new one if
+// there is no file yet. created says which it was.
+func LoadOrCreate(path string, passphrase []byte) (key crypto.PrivKey, created bool, err error) {
+	key, err = Load(path, passphrase)
+	if !errors.Is(err, os.ErrNotExist) {
+		return key, false, err
+	}
+	if key, err = Generate(); err != nil {
+		return nil, false, err
+	}
+	return key, true, Save(path, key, passphrase)
+}
+
+// Option is the libp2p option giving a host the key at path, or a fresh
+// one each run if path is empty
+func Option(path string) (libp2p.Option, error) {
+	if path == "" {
+		return libp2p.RandomIdentity, nil
+	}
+	key, _, err := LoadOrCreate(path, Passphrase())
+	if err != nil {
+		return nil, err
+	}
+	return libp2p.Identity(key), nil
+}
+
+// scrypt parameters, as recommended for interactive logins in 2017
+const (
+	scryptN   = 1 << 15
+	scryptR   = 8
+	scryptP   = 1
+	keyLength = 32
+)
+
+// encrypt seals raw with AES-GCM, under a key scrypt derives from passphrase
+func encrypt(raw, passphrase []byte) (*pem.Block, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return &pem.Block{
+		Type: encryptedBlock,
+		Headers: map[string]string{
+			"Kdf":   "scrypt",
+			"Salt":  hex.EncodeToString(salt),
+			"Nonce": hex.EncodeToString(nonce),
+		},
+		Bytes: gcm.Seal(nil, nonce, raw, nil),
+	}, nil
+}
+
+func decrypt(block *pem.Block, passphrase []byte) ([]byte, error) {
+	if len(passphrase) == 0 {
+		return nil, ErrPassphrase
+	}
+	salt, err := hex.DecodeString(block.Headers["Salt"])
+	if err != nil {
+		return nil, errNotKey
+	}
+	nonce, err := hex.DecodeString(block.Headers["Nonce"])
+	if err != nil {
+		return nil, errNotKey
+	}
+	gcm, err := newGCM(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != gcm.NonceSize() {
+		return nil, errNotKey
+	}
+	raw, err := gcm.Open(nil, nonce, block.Bytes, nil)
+	if err != nil {
+		return nil, ErrPassphrase
+	}
+	return raw, nil
+}
+
+func newGCM(passphrase, salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key(passphrase, salt, scryptN, scryptR, scryptP, keyLength)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,59 @@
+package identity
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+func TestLoadOrCreate(t *testing.T) {
+	for _, pass := range [][]byte{nil, []byte("secret")} {
+		path := filepath.Join(t.TempDir(), "id.key")
+		key, created, err := LoadOrCreate(path, pass)
+		if err != nil || !created {
+			t.Fatalf("first LoadOrCreate: created %v, error %v", created, err)
+		}
+		again, created, err := LoadOrCreate(path, pass)
+		if err != nil || created {
+			t.Fatalf("second LoadOrCreate: created %v, error %v", created, err)
+		}
+		a, _ := peer.IDFromPrivateKey(key)
+		b, _ := peer.IDFromPrivateKey(again)
+		if a != b {
+			t.Errorf("peer ID changed from %s to %s", a, b)
+		}
+		if pass == nil {
+			continue
+		}
+		if _, err := Load(path, []byte("wrong")); !errors.Is(err, ErrPassphrase) {
+			t.Errorf("wrong passphrase: error = %v, wanted ErrPassphrase", err)
+		}
+		if _, err := Load(path, nil); !errors.Is(err, ErrPassphrase) {
+			t.Errorf("no passphrase: error = %v, wanted ErrPassphrase", err)
+		}
+	}
+}
+
+func TestCommand(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "id.key")
+	var out bytes.Buffer
+	if err := Command("test", []string{"generate", "-key", path}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(out.Bytes(), []byte("peer ID:")) {
+		t.Errorf("generate printed %q", out.String())
+	}
+	if err := Command("test", []string{"generate", "-key", path}, &out); err == nil {
+		t.Error("generate overwrote an existing key")
+	}
+	out.Reset()
+	if err := Command("test", []string{"export", "-key", path}, &out); err != nil || out.Len() == 0 {
+		t.Errorf("export: %q, error %v", out.String(), err)
+	}
+	if err := Command("test", []string{"burn"}, &out); err == nil {
+		t.Error("unknown subcommand ran")
+	}
+}
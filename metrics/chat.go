@@ -0,0 +1,69 @@
+package metrics
+
+import (
+	"github.com/bpc2016/p2p/chat"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	chatIn = prometheus.NewDesc("chat_messages_received_total",
+		"Messages that reached us in the room, heartbeats included.", []string{"room"}, nil)
+	chatOut = prometheus.NewDesc("chat_messages_sent_total",
+		"Messages we sent in the room, on the topic or in private.", []string{"room"}, nil)
+	chatRejected = prometheus.NewDesc("chat_messages_rejected_total",
+		"Messages the room dropped: forged, unreadable, too big or too fast.", []string{"room"}, nil)
+	chatDiscovered = prometheus.NewDesc("chat_discovery_peers_total",
+		"Peers DHT discovery found for the room, by whether we could connect to them.", []string{"room", "result"}, nil)
+	chatPeers = prometheus.NewDesc("chat_topic_peers",
+		"Peers we share the room's topic with.", []string{"room"}, nil)
+	chatMesh = prometheus.NewDesc("chat_mesh_peers",
+		"Peers in our gossipsub mesh for the room.", []string{"room"}, nil)
+	chatBuffer = prometheus.NewDesc("chat_buffer_fill_ratio",
+		"How full a channel is, 1 when its reader is falling behind. Room is empty for the manager's own.", []string{"room", "channel"}, nil)
+)
+
+// Chat collects the metrics of every room m is in
+func Chat(m *chat.Manager) prometheus.Collector {
+	return chatCollector{m}
+}
+
+type chatCollector struct {
+	m *chat.Manager
+}
+
+func (c chatCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range []*prometheus.Desc{chatIn, chatOut, chatRejected, chatDiscovered, chatPeers, chatMesh, chatBuffer} {
+		ch <- d
+	}
+}
+
+func (c chatCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, name := range c.m.Rooms() {
+		room, ok := c.m.Room(name)
+		if !ok {
+			continue // left in the meantime
+		}
+		st := room.Stats()
+		ch <- prometheus.MustNewConstMetric(chatIn, prometheus.CounterValue, float64(st.MessagesIn), name)
+		ch <- prometheus.MustNewConstMetric(chatOut, prometheus.CounterValue, float64(st.MessagesOut), name)
+		ch <- prometheus.MustNewConstMetric(chatRejected, prometheus.CounterValue, float64(st.Rejected), name)
+		ch <- prometheus.MustNewConstMetric(chatDiscovered, prometheus.CounterValue, float64(st.Connected), name, "connected")
+		ch <- prometheus.MustNewConstMetric(chatDiscovered, prometheus.CounterValue, float64(st.Unreachable), name, "unreachable")
+		ch <- prometheus.MustNewConstMetric(chatPeers, prometheus.GaugeValue, float64(st.Peers), name)
+		ch <- prometheus.MustNewConstMetric(chatMesh, prometheus.GaugeValue, float64(st.Mesh), name)
+		ch <- fill(name, "messages", len(room.Messages), cap(room.Messages))
+		ch <- fill(name, "data", len(room.Data), cap(room.Data))
+		ch <- fill(name, "events", len(room.Events), cap(room.Events))
+	}
+	ch <- fill("", "messages", len(c.m.Messages), cap(c.m.Messages))
+	ch <- fill("", "data", len(c.m.Data), cap(c.m.Data))
+	ch <- fill("", "events", len(c.m.Events), cap(c.m.Events))
+}
+
+func fill(room, channel string, n, size int) prometheus.Metric {
+	ratio := 0.0
+	if size > 0 {
+		ratio = float64(n) / float64(size)
+	}
+	return prometheus.MustNewConstMetric(chatBuffer, prometheus.GaugeValue, ratio, room, channel)
+}
@@ -0,0 +1,125 @@
+package metrics
+
+import (
+	"github.com/libp2p/go-libp2p/core/host"
+	bandwidth "github.com/libp2p/go-libp2p/core/metrics"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/proto"
+	"github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/relay"
+	"github.com/prometheus/client_golang/prometheus"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// ReservationTag is how the relay marks the peers it holds a reservation
+// for, in the host's connection manager
+const ReservationTag = "relay-reservation"
+
+// Reserved tells whether the relay on h holds a reservation for p
+func Reserved(h host.Host, p peer.ID) bool {
+	info := h.ConnManager().GetTagInfo(p)
+	return info != nil && info.Tags[ReservationTag] > 0
+}
+
+var (
+	relayReservations = prometheus.NewDesc("relay_reservations",
+		"Peers holding a reservation.", nil, nil)
+	relayCircuits = prometheus.NewDesc("relay_circuits",
+		"Circuits open through the relay.", nil, nil)
+	relayBytes = prometheus.NewDesc("relay_bytes_total",
+		"Bytes relayed, towards the destination of a circuit or back to its source.", []string{"direction"}, nil)
+	relayPeers = prometheus.NewDesc("relay_connected_peers",
+		"Peers connected to the relay.", nil, nil)
+)
+
+// Relay collects the metrics of the circuit relay on a host. It sees
+// requests through the relay's ACL hook: hand it to relay.WithACL, with
+// the ACL the relay would have had (nil for none) as next.
+//
+// Refusals are counted by whatever refuses, see Refused: the relay keeps
+// those over its limits to itself.
+type Relay struct {
+	h    host.Host
+	bw   *bandwidth.BandwidthCounter
+	next relay.ACLFilter
+
+	requests *prometheus.CounterVec
+	refused  *prometheus.CounterVec
+}
+
+// NewRelay watches the relay on h. bw has to be the host's bandwidth
+// reporter, see libp2p.BandwidthReporter.
+func NewRelay(h host.Host, bw *bandwidth.BandwidthCounter, next relay.ACLFilter) *Relay {
+	return &Relay{
+		h:    h,
+		bw:   bw,
+		next: next,
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "relay_requests_total",
+			Help: "Reservation and connect requests made to the relay.",
+		}, []string{"type"}),
+		refused: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "relay_refusals_total",
+			Help: "Requests the relay refused, by reason.",
+		}, []string{"type", "reason"}),
+	}
+}
+
+var _ relay.ACLFilter = (*Relay)(nil)
+
+// AllowReserve counts the request, then asks next
+func (r *Relay) AllowReserve(p peer.ID, a ma.Multiaddr) bool {
+	r.requests.WithLabelValues("reserve").Inc()
+	return r.next == nil || r.next.AllowReserve(p, a)
+}
+
+// AllowConnect counts the request, then asks next
+func (r *Relay) AllowConnect(src peer.ID, srcAddr ma.Multiaddr, dest peer.ID) bool {
+	r.requests.WithLabelValues("connect").Inc()
+	return r.next == nil || r.next.AllowConnect(src, srcAddr, dest)
+}
+
+// Refused counts the requests a filter turns away for reason: the filter
+// calls it with "reserve" or "connect" each time
+func (r *Relay) Refused(reason string) func(typ string) {
+	return func(typ string) {
+		r.refused.WithLabelValues(typ, reason).Inc()
+	}
+}
+
+func (r *Relay) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range []*prometheus.Desc{relayReservations, relayCircuits, relayBytes, relayPeers} {
+		ch <- d
+	}
+	r.requests.Describe(ch)
+	r.refused.Describe(ch)
+}
+
+func (r *Relay) Collect(ch chan<- prometheus.Metric) {
+	peers := r.h.Network().Peers()
+	reservations := 0
+	for _, p := range peers {
+		if Reserved(r.h, p) {
+			reservations++
+		}
+	}
+	// each circuit has a stop stream, from the relay to its destination
+	circuits := 0
+	for _, c := range r.h.Network().Conns() {
+		for _, s := range c.GetStreams() {
+			if s.Protocol() == proto.ProtoIDv2Stop {
+				circuits++
+			}
+		}
+	}
+	ch <- prometheus.MustNewConstMetric(relayReservations, prometheus.GaugeValue, float64(reservations))
+	ch <- prometheus.MustNewConstMetric(relayCircuits, prometheus.GaugeValue, float64(circuits))
+	ch <- prometheus.MustNewConstMetric(relayPeers, prometheus.GaugeValue, float64(len(peers)))
+	if r.bw != nil {
+		st := r.bw.GetBandwidthForProtocol(proto.ProtoIDv2Stop)
+		ch <- prometheus.MustNewConstMetric(relayBytes, prometheus.CounterValue, float64(st.TotalOut), "destination")
+		ch <- prometheus.MustNewConstMetric(relayBytes, prometheus.CounterValue, float64(st.TotalIn), "source")
+	}
+	r.requests.Collect(ch)
+	r.refused.Collect(ch)
+}
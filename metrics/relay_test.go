@@ -0,0 +1,69 @@
+package metrics
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p"
+	bandwidth "github.com/libp2p/go-libp2p/core/metrics"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/client"
+	"github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/relay"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRelay(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	bw := bandwidth.NewBandwidthCounter()
+	rh, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"), libp2p.BandwidthReporter(bw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rh.Close()
+	stats := NewRelay(rh, bw, nil)
+	rly, err := relay.New(rh, relay.WithACL(stats))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rly.Close()
+
+	h, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	ri := peer.AddrInfo{ID: rh.ID(), Addrs: rh.Addrs()}
+	if err := h.Connect(ctx, ri); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Reserve(ctx, h, ri); err != nil {
+		t.Fatal(err)
+	}
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(stats)
+	if n := testutil.ToFloat64(stats.requests.WithLabelValues("reserve")); n != 1 {
+		t.Errorf("%v reservation requests, want 1", n)
+	}
+	stats.Refused("ban")("connect")
+	if n := testutil.ToFloat64(stats.refused.WithLabelValues("connect", "ban")); n != 1 {
+		t.Errorf("%v refusals, want 1", n)
+	}
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]float64{}
+	for _, f := range families {
+		if m := f.GetMetric(); len(m) == 1 && m[0].GetGauge() != nil {
+			got[f.GetName()] = m[0].GetGauge().GetValue()
+		}
+	}
+	if got["relay_reservations"] != 1 || got["relay_connected_peers"] != 1 || got["relay_circuits"] != 0 {
+		t.Errorf("got %v", got)
+	}
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"nhooyr.io/websocket"
+)
+
+// the local API (-api), for dashboards and the like that would rather not
+// link libp2p. Every request needs the token, as "Authorization: Bearer
+// <token>" or, for browsers opening a WebSocket, ?token=<token>. Web pages
+// served from elsewhere need their origin in -api-origin too: host
+// patterns such as localhost:3000 or *.example.com.
+//
+//	GET    /rooms                    the rooms we are in
+//	POST   /rooms/<room>             join it, the console stays where it is
+//	DELETE /rooms/<room>             leave it
+//	GET    /rooms/<room>/peers       who is in it, see chat.Presence
+//	GET    /rooms/<room>/history?n=  the last n messages, 50 unless told
+//	POST   /rooms/<room>/messages    {"to":..,"text":..,"data":..} says it there
+//	GET    /events?room=             a WebSocket: messages and data as they
+//	                                 come, as records (see json.go)
+
+// apiBuffer is how many records a slow WebSocket client may fall behind
+// before it misses some
+const apiBuffer = 64
+
+type apiServer struct {
+	cr      *ChatRoom
+	token   string
+	origins []string // host patterns of the web pages that may use us
+	srv     *http.Server
+
+	mu   sync.Mutex
+	subs map[chan *record]bool
+}
+
+// newToken makes a token for when -api-token gives none
+func newToken() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// startAPI serves the API on addr, which has to be a loopback one, to
+// pages from origins as well as to local programs
+func startAPI(cr *ChatRoom, addr, token string, origins []string) (*apiServer, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("-api: %v", err)
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return nil, fmt.Errorf("-api: %s is not a local address, try 127.0.0.1%s", host, strings.TrimPrefix(addr, host))
+	}
+	for _, pattern := range origins {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("-api-origin: %q: %v", pattern, err)
+		}
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	a := newAPI(cr, token, origins)
+	a.srv = &http.Server{Handler: a.handler()}
+	go a.srv.Serve(ln)
+	return a, nil
+}
+
+func newAPI(cr *ChatRoom, token string, origins []string) *apiServer {
+	return &apiServer{cr: cr, token: token, origins: origins, subs: make(map[chan *record]bool)}
+}
+
+// Close stops serving, WebSockets included
+func (a *apiServer) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	a.mu.Lock()
+	for ch := range a.subs {
+		close(ch)
+		delete(a.subs, ch)
+	}
+	a.mu.Unlock()
+	return a.srv.Shutdown(ctx)
+}
+
+// broadcast passes r to every WebSocket, those that can take it
+func (a *apiServer) broadcast(r *record) {
+	if r.Time.IsZero() {
+		r.Time = time.Now()
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for ch := range a.subs {
+		select {
+		case ch <- r:
+		default: // too slow, it misses this one
+		}
+	}
+}
+
+func (a *apiServer) subscribe() chan *record {
+	ch := make(chan *record, apiBuffer)
+	a.mu.Lock()
+	a.subs[ch] = true
+	a.mu.Unlock()
+	return ch
+}
+
+func (a *apiServer) unsubscribe(ch chan *record) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.subs[ch] {
+		delete(a.subs, ch)
+		close(ch)
+	}
+}
+
+func (a *apiServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/rooms", a.rooms)
+	mux.HandleFunc("/rooms/", a.room)
+	mux.HandleFunc("/events", a.events)
+	return a.cors(a.auth(mux))
+}
+
+// allowed is the Origin of r, if it is one of ours. The patterns match the
+// host, as websocket.AcceptOptions.OriginPatterns do.
+func (a *apiServer) allowed(r *http.Request) (string, bool) {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return "", false
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return "", false
+	}
+	for _, pattern := range a.origins {
+		if ok, _ := filepath.Match(strings.ToLower(pattern), strings.ToLower(u.Host)); ok {
+			return origin, true
+		}
+	}
+	return "", false
+}
+
+// cors lets the pages of our origins read what we answer. Their preflight
+// requests carry no token, and are answered here.
+func (a *apiServer) cors(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if origin, ok := a.allowed(r); ok {
+			h := w.Header()
+			h.Set("Access-Control-Allow-Origin", origin)
+			h.Add("Vary", "Origin")
+			if r.Method == http.MethodOptions {
+				h.Set("Access-Control-Allow-Methods", "GET, POST, DELETE")
+				h.Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+				h.Set("Access-Control-Max-Age", "600")
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// auth turns away requests without the token
+func (a *apiServer) auth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if token == "" {
+			token = r.URL.Query().Get("token")
+		}
+		if subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) != 1 {
+			apiError(w, http.StatusUnauthorized, fmt.Errorf("bad or missing token"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+type roomInfo struct {
+	Name   string `json:"name"`
+	Active bool   `json:"active"`
+	Home   bool   `json:"home"`
+	Peers  int    `json:"peers"`
+}
+
+// GET /rooms
+func (a *apiServer) rooms(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		apiError(w, http.StatusMethodNotAllowed, fmt.Errorf("GET only"))
+		return
+	}
+	active := ""
+	if room := a.cr.rooms.Active(); room != nil {
+		active = room.Room()
+	}
+	infos := []roomInfo{}
+	for _, name := range a.cr.rooms.Rooms() {
+		info := roomInfo{Name: name, Active: name == active, Home: name == a.cr.home}
+		if room, ok := a.cr.rooms.Room(name); ok {
+			info.Peers = len(room.ListPeers())
+		}
+		infos = append(infos, info)
+	}
+	apiReply(w, infos)
+}
+
+// /rooms/<room>[/peers|/history|/messages]
+func (a *apiServer) room(w http.ResponseWriter, r *http.Request) {
+	name, what, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/rooms/"), "/")
+	if name == "" {
+		apiError(w, http.StatusNotFound, fmt.Errorf("which room?"))
+		return
+	}
+	switch {
+	case what == "" && r.Method == http.MethodPost:
+		// the console goes on talking where it was
+		_, err := a.cr.rooms.Enter(name)
+		a.reply(w, nil, err)
+	case what == "" && r.Method == http.MethodDelete:
+		if name == a.cr.home {
+			apiError(w, http.StatusConflict, fmt.Errorf("%s is home", name))
+			return
+		}
+		a.reply(w, nil, a.cr.rooms.Leave(name))
+	case what == "peers" && r.Method == http.MethodGet:
+		room, err := a.cr.room(name)
+		if err != nil {
+			apiError(w, http.StatusNotFound, err)
+			return
+		}
+		apiReply(w, room.Roster())
+	case what == "history" && r.Method == http.MethodGet:
+		a.history(w, r, name)
+	case what == "messages" && r.Method == http.MethodPost:
+		a.publish(w, r, name)
+	default:
+		apiError(w, http.StatusNotFound, fmt.Errorf("no %s %s", r.Method, r.URL.Path))
+	}
+}
+
+func (a *apiServer) history(w http.ResponseWriter, r *http.Request, name string) {
+	if a.cr.history == nil {
+		apiError(w, http.StatusNotFound, fmt.Errorf("no history kept, see -history"))
+		return
+	}
+	// only rooms we are in: each room's history is a file, kept open
+	if _, err := a.cr.room(name); err != nil {
+		apiError(w, http.StatusNotFound, err)
+		return
+	}
+	n := 50
+	if s := r.URL.Query().Get("n"); s != "" {
+		var err error
+		if n, err = strconv.Atoi(s); err != nil || n < 1 {
+			apiError(w, http.StatusBadRequest, fmt.Errorf("n: a number, 1 or more"))
+			return
+		}
+	}
+	recs, err := a.cr.history.Last(name, n)
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, err)
+		return
+	}
+	out := []*record{}
+	for _, rec := range recs {
+		mr := messageRecord(rec.Message)
+		mr.Room, mr.Time = name, rec.Time
+		out = append(out, mr)
+	}
+	apiReply(w, out)
+}
+
+// publish goes the way typed messages do, see ChatRoom.Publish
+func (a *apiServer) publish(w http.ResponseWriter, r *http.Request, name string) {
+	var body struct {
+		To   string `json:"to"`
+		Text string `json:"text"`
+		Data []byte `json:"data"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		apiError(w, http.StatusBadRequest, err)
+		return
+	}
+	room, err := a.cr.room(name)
+	if err != nil {
+		apiError(w, http.StatusNotFound, err)
+		return
+	}
+	a.reply(w, nil, room.Publish(body.Text+"\n", body.To, body.Data))
+}
+
+// GET /events: a WebSocket, a record a message
+func (a *apiServer) events(w http.ResponseWriter, r *http.Request) {
+	room := r.URL.Query().Get("room")
+	c, err := websocket.Accept(w, r, &websocket.AcceptOptions{OriginPatterns: a.origins})
+	if err != nil {
+		return // Accept has answered
+	}
+	defer c.Close(websocket.StatusInternalError, "")
+
+	ch := a.subscribe()
+	defer a.unsubscribe(ch)
+	ctx := c.CloseRead(r.Context()) // we only write
+	for {
+		select {
+		case rec, ok := <-ch:
+			if !ok {
+				c.Close(websocket.StatusGoingAway, "bye")
+				return
+			}
+			if room != "" && rec.Room != room {
+				continue
+			}
+			b, _ := json.Marshal(rec)
+			wctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+			err := c.Write(wctx, websocket.MessageText, b)
+			cancel()
+			if err != nil {
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// reply is apiReply, or apiError if err
+func (a *apiServer) reply(w http.ResponseWriter, v any, err error) {
+	if err != nil {
+		apiError(w, http.StatusBadRequest, err)
+		return
+	}
+	if v == nil {
+		v = struct {
+			OK bool `json:"ok"`
+		}{true}
+	}
+	apiReply(w, v)
+}
+
+func apiReply(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func apiError(w http.ResponseWriter, code int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(struct {
+		Error string `json:"error"`
+	}{err.Error()})
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bpc2016/p2p/chat"
+	"nhooyr.io/websocket"
+)
+
+func TestAPI(t *testing.T) {
+	a := newAPI(&ChatRoom{}, "secret", nil)
+	srv := httptest.NewServer(a.handler())
+	defer srv.Close()
+
+	get := func(path, token string) int {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := get("/rooms/lobby/history", ""); code != http.StatusUnauthorized {
+		t.Errorf("no token: %d", code)
+	}
+	if code := get("/rooms/lobby/history", "wrong"); code != http.StatusUnauthorized {
+		t.Errorf("wrong token: %d", code)
+	}
+	if code := get("/rooms/lobby/history", "secret"); code != http.StatusNotFound {
+		t.Errorf("no history: %d", code)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/events?room=lobby&token=secret"
+	c, _, err := websocket.Dial(ctx, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close(websocket.StatusNormalClosure, "")
+	for subscribed := false; !subscribed; { // the server side has to get there first
+		time.Sleep(10 * time.Millisecond)
+		a.mu.Lock()
+		subscribed = len(a.subs) > 0
+		a.mu.Unlock()
+	}
+
+	a.broadcast(messageRecord(&chat.ChatMessage{Message: "elsewhere\n", Room: "attic"}))
+	a.broadcast(messageRecord(&chat.ChatMessage{Message: "hi\n", SenderNick: "bob", Room: "lobby"}))
+	_, b, err := c.Read(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rec record
+	if err := json.Unmarshal(b, &rec); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Type != "message" || rec.Text != "hi" || rec.Nick != "bob" {
+		t.Errorf("got %+v", rec)
+	}
+}
+
+// pages from -api-origin may use the API, others only from the same origin
+func TestAPIOrigins(t *testing.T) {
+	a := newAPI(&ChatRoom{}, "secret", []string{"localhost:3000", "*.example.com"})
+	srv := httptest.NewServer(a.handler())
+	defer srv.Close()
+
+	do := func(method, origin string, header ...string) *http.Response {
+		req, _ := http.NewRequest(method, srv.URL+"/rooms/lobby/history", nil)
+		req.Header.Set("Origin", origin)
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	// the preflight needs no token
+	resp := do(http.MethodOptions, "https://dash.example.com", "Access-Control-Request-Method", "GET")
+	if resp.StatusCode != http.StatusNoContent || resp.Header.Get("Access-Control-Allow-Origin") != "https://dash.example.com" ||
+		!strings.Contains(resp.Header.Get("Access-Control-Allow-Headers"), "Authorization") {
+		t.Errorf("preflight: %d %v", resp.StatusCode, resp.Header)
+	}
+	resp = do(http.MethodGet, "http://localhost:3000", "Authorization", "Bearer secret")
+	if resp.StatusCode != http.StatusNotFound || resp.Header.Get("Access-Control-Allow-Origin") != "http://localhost:3000" {
+		t.Errorf("allowed origin: %d %v", resp.StatusCode, resp.Header)
+	}
+	resp = do(http.MethodGet, "https://evil.test", "Authorization", "Bearer secret")
+	if resp.Header.Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("other origin let in: %v", resp.Header)
+	}
+	if resp = do(http.MethodOptions, "https://evil.test"); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("other origin preflight: %d", resp.StatusCode)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/events?token=secret"
+	dial := func(origin string) error {
+		c, _, err := websocket.Dial(ctx, url, &websocket.DialOptions{HTTPHeader: http.Header{"Origin": {origin}}})
+		if err == nil {
+			c.Close(websocket.StatusNormalClosure, "")
+		}
+		return err
+	}
+	if err := dial("https://dash.example.com"); err != nil {
+		t.Errorf("allowed origin, websocket: %v", err)
+	}
+	if err := dial("https://evil.test"); err == nil {
+		t.Error("other origin, websocket let in")
+	}
+}
+
+func TestAPIHistory(t *testing.T) {
+	cr := roomsSetup(t)
+	dir := t.TempDir()
+	var err error
+	if cr.history, err = chat.OpenHistory(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer cr.history.Close()
+	srv := httptest.NewServer(newAPI(cr, "secret", nil).handler())
+	defer srv.Close()
+
+	get := func(path string) int {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+path, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := get("/rooms/lobby/history"); code != http.StatusOK {
+		t.Errorf("lobby history: %d", code)
+	}
+	if code := get("/rooms/elsewhere/history"); code != http.StatusNotFound {
+		t.Errorf("history of a room we are not in: %d", code)
+	}
+	if files, _ := os.ReadDir(dir); len(files) != 1 {
+		t.Errorf("history files %v, wanted lobby's alone", files)
+	}
+}
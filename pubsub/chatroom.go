@@ -2,208 +2,225 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
-	"regexp"
+	"os"
+	"sort"
 	"strings"
+	"time"
 
+	"github.com/bpc2016/p2p/chat"
 	"github.com/libp2p/go-libp2p/core/host"
 	"github.com/libp2p/go-libp2p/core/peer"
-
-	pubsub "github.com/libp2p/go-libp2p-pubsub"
 )
 
-// ChatRoomBufSize is the number of incoming messages to buffer for each topic.
-const ChatRoomBufSize = 128
-
-// ChatRoom represents a subscription to a single PubSub topic. Messages
-// can be published to the topic with ChatRoom.Publish, and received
-// messages are pushed to the Messages channel.
+// ChatRoom is the console's side of the chat: it adds the commands typed
+// at the keyboard to a chat.Manager, and remembers the way home.
+// Whatever we type goes to the active room.
 type ChatRoom struct {
-	// Messages is a channel of messages received from other peers in the chat room
-	Messages chan *ChatMessage
-	// Data is a channel for binary carried as payload
-	Data chan *ChatData
-
-	ctx   context.Context
-	ps    *pubsub.PubSub
-	topic *pubsub.Topic
-	sub   *pubsub.Subscription
-
-	roomName  string
-	self      peer.ID
-	nick      string
-	home      string
-	homeTopic *pubsub.Topic
-	quit      chan struct{}
+	rooms   *chat.Manager
+	history *chat.History
+	cmds    *chat.Registry
+	policy  *chat.Policy
+
+	h    host.Host
+	nick string
+	home string
+	quit func()     // ends the chat, see main
+	json *jsonMode  // set with -json
+	api  *apiServer // set with -api
 }
 
-// ChatMessage gets converted to/from JSON and sent in the body of pubsub messages.
-type ChatMessage struct {
-	Message    string
-	To         string
-	Payload    []byte
-	SenderID   string
-	SenderNick string
+// call this on a chatroom object in main(), roomName becomes the active room
+func (cr *ChatRoom) JoinChat(roomName string) error {
+	_, err := cr.rooms.Join(roomName)
+	return err
 }
 
-type ChatData struct {
-	Data       []byte
-	SenderNick string
+// Publish says something in the active room
+func (cr *ChatRoom) Publish(message string, to string, payload []byte) error {
+	return cr.rooms.Publish(message, to, payload)
 }
 
-// call this on a chatroom object in main()
-func (cr *ChatRoom) JoinChat(h host.Host, roomName string) error {
-	var (
-		topic *pubsub.Topic
-		err   error
-	)
-	if cr.homeTopic != nil && roomName == cr.home {
-		// we are returning home ...
-		topic = cr.homeTopic
-	} else {
-		// join the pubsub topic
-		topic, err = cr.ps.Join(topicName(roomName))
-		if err != nil {
-			return err
+// ListPeers lists who is in the active room
+func (cr *ChatRoom) ListPeers() []peer.ID {
+	if room := cr.rooms.Active(); room != nil {
+		return room.ListPeers()
+	}
+	return nil
+}
+
+// listRooms lists the rooms we are in, marking the active one
+func (cr *ChatRoom) listRooms() string {
+	active := ""
+	if room := cr.rooms.Active(); room != nil {
+		active = room.Room()
+	}
+	var names []string
+	for _, name := range cr.rooms.Rooms() {
+		if name == active {
+			name = "*" + name
 		}
+		names = append(names, name)
 	}
+	return strings.Join(names, " ")
+}
 
-	// and subscribe to it
-	sub, err := topic.Subscribe()
+// showHistory is the last n messages of the room we talk in
+func (cr *ChatRoom) showHistory(n int) (string, error) {
+	room := cr.rooms.Active()
+	if cr.history == nil || room == nil {
+		return "", fmt.Errorf("no history kept, see -history")
+	}
+	recs, err := cr.history.Last(room.Room(), n)
 	if err != nil {
-		return err
+		return "", err
 	}
-
-	cr.topic = topic
-	cr.sub = sub
-	cr.roomName = roomName
-	cr.Messages = make(chan *ChatMessage, ChatRoomBufSize)
-	cr.Data = make(chan *ChatData, ChatRoomBufSize)
-
-	// use DHT
-	go cr.discoverPeers(cr.ctx, h)
-
-	// write message
-	go cr.streamConsoleTo(h)
-
-	// start reading messages from the subscription in a loop
-	go cr.readLoop(h)
-	return nil
+	var b strings.Builder
+	for _, rec := range recs {
+		b.WriteString(colourLine(rec.Time.Format("15:04 ")+rec.Message.From(), rec.Message.Message))
+	}
+	return b.String(), nil
 }
 
-// Publish sends a message to the pubsub topic.
-func (cr *ChatRoom) Publish(message string, to string, payload []byte) error {
-	m := ChatMessage{
-		Message:    message,
-		To:         to,
-		Payload:    payload,
-		SenderID:   cr.self.Pretty(),
-		SenderNick: cr.nick,
+// moveTo takes us to roomName. The room we were talking in is left behind,
+// subscription, readers and discovery, unless it is home: we keep that one
+// joined, so that going back is immediate. The rooms tell their members
+// we came and went, see chat.EventJoin.
+func (cr *ChatRoom) moveTo(roomName string) (string, error) {
+	if roomName == "" {
+		return "", fmt.Errorf("which room?")
 	}
-
-	// fmt.Printf("** message: %s to %q\n", m.Message, m.To) // ***
-
-	msgBytes, err := json.Marshal(m)
-	if err != nil {
-		return err
+	prev := cr.rooms.Active()
+	if prev != nil && prev.Room() == roomName {
+		return "", fmt.Errorf("already in %s", roomName)
 	}
-	return cr.topic.Publish(cr.ctx, msgBytes)
+	if err := cr.JoinChat(roomName); err != nil {
+		return "", err
+	}
+	out := ""
+	if prev != nil && prev.Room() != cr.home {
+		if err := cr.rooms.Leave(prev.Room()); err != nil {
+			return "", err
+		}
+		out = fmt.Sprintf("left %s\n", prev.Room())
+	}
+	return out + fmt.Sprintf("now in %s\n", roomName), nil
 }
 
-func (cr *ChatRoom) ListPeers() []peer.ID {
-	return cr.ps.ListPeers(topicName(cr.roomName))
+// leave quits the room we talk in and goes home
+func (cr *ChatRoom) leave() (string, error) {
+	room := cr.rooms.Active()
+	if room == nil || room.Room() == cr.home {
+		return "", fmt.Errorf("this is home, use /quit to leave it")
+	}
+	return cr.moveTo(cr.home)
 }
 
-// readLoop pulls messages from the pubsub topic and pushes them onto the Messages channel.
-func (cr *ChatRoom) readLoop(h host.Host) {
-	for {
-		msg, err := cr.sub.Next(cr.ctx)
-		if err != nil {
-			close(cr.Messages)
-			return
+// who is the active room's roster
+func (cr *ChatRoom) who() (string, error) {
+	room := cr.rooms.Active()
+	if room == nil {
+		return "", fmt.Errorf("not in a room")
+	}
+	var b strings.Builder
+	for _, pr := range room.Roster() {
+		seen := "you"
+		if !pr.Self {
+			seen = fmt.Sprintf("seen %s ago", time.Since(pr.LastSeen).Round(time.Second))
 		}
-		// only forward messages delivered by others
-		if msg.ReceivedFrom == cr.self {
-			continue
+		line := fmt.Sprintf("%s~%s (%s)", pr.Nick, chat.ShortID(pr.Peer), seen)
+		if pr.Status != "" {
+			line += ": " + pr.Status
 		}
+		fmt.Fprintln(&b, line)
+	}
+	return b.String(), nil
+}
 
-		cm := new(ChatMessage)
-		err = json.Unmarshal(msg.Data, cm)
+// inf has user fetch some fixed content for us, printing what comes back
+func (cr *ChatRoom) inf(user string) error {
+	room := cr.rooms.Active()
+	if room == nil {
+		return fmt.Errorf("not in a room")
+	}
+	p, err := room.FindPeer(user)
+	if err != nil {
+		return err
+	}
+	go func() {
+		r, err := room.Call(context.Background(), p, "/fetch", "this is fixed content")
 		if err != nil {
-			continue
-		}
-
-		// is this personal message, skip if not mine
-		minere := regexp.MustCompile(shortID(h.ID()))
-		if cm.To != "" && !minere.MatchString(cm.To) {
-			continue
+			fmt.Printf("/inf %s: %v\n", user, err)
+			return
 		}
+		from := r.Nick + " (reply)"
+		printLine(from, r.Message)
+		printLine(from, fmt.Sprintf("%s\n", r.Payload))
+	}()
+	return nil
+}
 
-		// is this a remote command?
-		if strings.HasPrefix(cm.Message, "/") {
-			if !cr.validCommand(cm.Message) {
-				fmt.Printf("invalid command : %q\n", cm.Message)
-				continue
-			}
-			cm.To = ""
-			// prep, if there is a payload, it comes out here as `p`
-			p, err := cr.handleCommands(&cm.Message, &cm.To, h)
-			if err != nil {
-				fmt.Printf("handlecomands error: %v\n", err)
-				continue
-			}
-			// new message back to sender
-			if err := cr.Publish(cm.Message, cm.Sender(), p); err != nil {
-				fmt.Printf("publish error: %v\n", err)
-			}
-			continue
-		}
-		// send the payloaded messages to data channel
-		if cm.Payload != nil && string(cm.Payload) != "" {
-			data := new(ChatData)
-			data.Data = cm.Payload
-			data.SenderNick = cm.SenderNick
-			// send both
-			cr.Messages <- cm
-			cr.Data <- data
-			continue
-		}
-		// send valid messages onto the Messages channel
-		cr.Messages <- cm
+// send offers file to the peer called to in the active room, and sends
+// it in the background once accepted
+func (cr *ChatRoom) send(to, file string) (string, error) {
+	room := cr.rooms.Active()
+	if room == nil {
+		return "", fmt.Errorf("not in a room")
+	}
+	p, err := room.FindPeer(to)
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(file); err != nil {
+		return "", err
 	}
+	go func() {
+		if err := room.SendFile(context.Background(), p, file); err != nil {
+			fmt.Printf("/send %s: %v\n", file, err)
+			return
+		}
+		fmt.Printf("sent %s to %s\n", file, to)
+	}()
+	return fmt.Sprintf("offered %s to %s\n", file, to), nil
 }
 
-// prefix the chatroom name (why?)
-func topicName(roomName string) string {
-	return "chat-room:" + roomName
+// offer picks the offer id, or the only one there is if id is empty
+func (cr *ChatRoom) offer(id string) (string, error) {
+	if id != "" {
+		return id, nil
+	}
+	offers := cr.rooms.Offers()
+	switch len(offers) {
+	case 0:
+		return "", fmt.Errorf("no files offered")
+	case 1:
+		return offers[0].ID, nil
+	}
+	var ids []string
+	for _, o := range offers {
+		ids = append(ids, fmt.Sprint(o))
+	}
+	return "", fmt.Errorf("which one?\n%s", strings.Join(ids, "\n"))
 }
 
-// JoinChatRoom tries to subscribe to the PubSub topic for the room name, returning
-// a ChatRoom on success.
-func JoinChatRoom(ctx context.Context, ps *pubsub.PubSub, selfID peer.ID, nickname string, roomName string) (*ChatRoom, error) {
-	// join the pubsub topic
-	topic, err := ps.Join(topicName(roomName))
-	if err != nil {
-		return nil, err
+// currentNick is the nickname we go by in the active room
+func (cr *ChatRoom) currentNick() string {
+	if room := cr.rooms.Active(); room != nil {
+		return room.Nick()
 	}
+	return cr.nick
+}
 
-	// and subscribe to it
-	sub, err := topic.Subscribe()
-	if err != nil {
-		return nil, err
+// listNicks is the active room's directory, by nickname
+func (cr *ChatRoom) listNicks() (string, error) {
+	room := cr.rooms.Active()
+	if room == nil {
+		return "", fmt.Errorf("not in a room")
 	}
-
-	cr := &ChatRoom{
-		ctx:      ctx,
-		ps:       ps,
-		topic:    topic,
-		sub:      sub,
-		self:     selfID,
-		nick:     nickname,
-		roomName: roomName,
-		Messages: make(chan *ChatMessage, ChatRoomBufSize),
+	var lines []string
+	for p, nick := range room.Nicks().All() {
+		lines = append(lines, fmt.Sprintf("%s~%s", nick, chat.ShortID(p)))
 	}
-
-	return cr, nil
+	sort.Strings(lines)
+	return strings.Join(lines, "\n") + "\n", nil
 }
@@ -4,79 +4,266 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"regexp"
+	"strconv"
 	"strings"
 
-	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/bpc2016/p2p/chat"
+	"github.com/libp2p/go-libp2p/core/peer"
 )
 
 var (
 	errSkip = errors.New("skip this input")
 )
 
-// these are commands that appear at the target, see where they are checked
-func (cr *ChatRoom) validCommand(s string) bool {
-	re := regexp.MustCompile(`(\S+)\s*(.*)\n`)
-	cmd := re.ReplaceAllString(s, "$1")
-	switch cmd {
-	case "/fetch", "/check", "/to", "/who", "/iam", "/q", "/h", "/in?", "/inf", "/peers",
-		"/iiam":
-		return true
+// registry holds every command the console knows, built on first use
+func (cr *ChatRoom) registry() *chat.Registry {
+	if cr.cmds == nil {
+		r, err := chat.NewRegistry(cr.commands()...)
+		if err != nil {
+			panic(err) // our own commands clash: fix the list below
+		}
+		cr.cmds = r
 	}
-	return false
+	return cr.cmds
 }
 
-// prepare data for pulishing
-func (cr *ChatRoom) handleCommands(s, to *string, h host.Host) ([]byte, error) {
-	re := regexp.MustCompile(`(\S+)\s*(.*)\n`)
-	cmd := re.ReplaceAllString(*s, "$1")
-	pars := re.ReplaceAllString(*s, "$2")
-	payload := []byte{}
+// commands: what we can type, and what other peers may ask of us (Where)
+func (cr *ChatRoom) commands() []*chat.Command {
+	return []*chat.Command{
+		{Name: "/who", Help: "who is in this room, and what they are up to", Where: chat.Local,
+			Run: func(c *chat.Call) (*chat.Result, error) {
+				return output(cr.who())
+			}},
+		{Name: "/inf", Args: "<user>", Help: "have <user> fetch some fixed content for us", Where: chat.Local,
+			Run: func(c *chat.Call) (*chat.Result, error) {
+				return nil, cr.inf(c.Args)
+			}},
+		{Name: "/fetch", Args: "<addr>", Help: "fetch <addr> as a json payload, usually as /to <user> /fetch <addr>", Where: chat.Both,
+			Run: func(c *chat.Call) (*chat.Result, error) {
+				// return this as a byte slice, manipulated
+				return &chat.Result{Message: "check the json payload\n", Payload: sampleFetch(c.Args)}, nil
+			}},
+		{Name: "/to", Args: "<who>|all <message>", Help: "say <message> to <who> alone: a nick, or enough of a peer ID", Where: chat.Local,
+			Run: func(c *chat.Call) (*chat.Result, error) {
+				// the single address follows directly
+				to, msg, _ := strings.Cut(c.Args, " ")
+				if to == "all" {
+					to = "" // fancy way of saying all --> ''
+				}
+				return &chat.Result{Message: strings.TrimSpace(msg) + "\n", To: to}, nil
+			}},
+		{Name: "/peers", Help: "list the peers in this room", Where: chat.Both,
+			Run: func(c *chat.Call) (*chat.Result, error) {
+				// never published, purely for information to the user
+				var b strings.Builder
+				for _, p := range cr.ListPeers() {
+					fmt.Fprintf(&b, "%v\n", p)
+				}
+				return &chat.Result{Output: b.String()}, nil
+			}},
+		{Name: "/iam", Help: "declare my short ID", Where: chat.Both,
+			Run: func(c *chat.Call) (*chat.Result, error) {
+				return &chat.Result{Message: fmt.Sprintf("%s = %s\n", cr.currentNick(), chat.ShortID(cr.h.ID()))}, nil
+			}},
+		{Name: "/nick", Args: "[name]", Help: "show your nickname, or change it in every room", Where: chat.Local,
+			Run: func(c *chat.Call) (*chat.Result, error) {
+				if c.Args != "" {
+					if err := cr.rooms.SetNick(c.Args); err != nil {
+						return nil, err
+					}
+					cr.nick = c.Args
+				}
+				return &chat.Result{Output: fmt.Sprintf("you are %s\n", cr.currentNick())}, nil
+			}},
+		{Name: "/status", Args: "[text]", Help: "set the status others see in /who, or clear it", Where: chat.Local,
+			Run: func(c *chat.Call) (*chat.Result, error) {
+				return nil, cr.rooms.SetStatus(c.Args)
+			}},
+		{Name: "/nicks", Help: "the nicknames people in this room go by", Where: chat.Local,
+			Run: func(c *chat.Call) (*chat.Result, error) {
+				return output(cr.listNicks())
+			}},
+		{Name: "/room", Args: "[room]", Help: "list the rooms you are in, or talk in another of them", Where: chat.Local,
+			Run: func(c *chat.Call) (*chat.Result, error) {
+				if c.Args != "" {
+					if err := cr.rooms.SetActive(c.Args); err != nil {
+						return nil, err
+					}
+				}
+				return &chat.Result{Output: fmt.Sprintf("rooms: %s\n", cr.listRooms())}, nil
+			}},
+		{Name: "/join", Args: "<room>", Help: "move to <room>, leaving the one you are in (home stays joined)", Where: chat.Local,
+			Run: func(c *chat.Call) (*chat.Result, error) {
+				return output(cr.moveTo(c.Args))
+			}},
+		{Name: "/leave", Help: "leave this room and go home", Where: chat.Local,
+			Run: func(c *chat.Call) (*chat.Result, error) {
+				return output(cr.leave())
+			}},
+		{Name: "/home", Help: "go back to the room you started in", Where: chat.Local,
+			Run: func(c *chat.Call) (*chat.Result, error) {
+				return output(cr.moveTo(cr.home))
+			}},
+		{Name: "/history", Args: "[n]", Help: "the last n (20) messages of this room, kept across restarts", Where: chat.Local,
+			Run: func(c *chat.Call) (*chat.Result, error) {
+				n := 20
+				if c.Args != "" {
+					var err error
+					if n, err = strconv.Atoi(c.Args); err != nil || n <= 0 {
+						return nil, fmt.Errorf("usage: /history [n]")
+					}
+				}
+				return output(cr.showHistory(n))
+			}},
+		{Name: "/acl", Help: "who may run which of our commands remotely", Where: chat.Local,
+			Run: func(c *chat.Call) (*chat.Result, error) {
+				return &chat.Result{Output: fmt.Sprintln(cr.policy)}, nil
+			}},
+		{Name: "/allow", Args: "<command> <peer>|all", Help: "let <peer> (or everyone) run <command> here", Where: chat.Local,
+			Run: func(c *chat.Call) (*chat.Result, error) {
+				name, who, err := cr.rule(c.Args)
+				if err != nil {
+					return nil, err
+				}
+				cmd, ok := cr.registry().Lookup(name)
+				if !ok || cmd.Where == chat.Local {
+					return nil, fmt.Errorf("%s can't be run remotely", name)
+				}
+				cr.policy.Allow(cmd.Name, who)
+				return nil, cr.policy.Save()
+			}},
+		{Name: "/revoke", Args: "<command>|all <peer>|all", Help: "take back what /allow gave", Where: chat.Local,
+			Run: func(c *chat.Call) (*chat.Result, error) {
+				name, who, err := cr.rule(c.Args)
+				if err != nil {
+					return nil, err
+				}
+				cr.policy.Revoke(name, who)
+				return nil, cr.policy.Save()
+			}},
+		{Name: "/deny", Args: "<peer>", Help: "refuse every command from <peer>", Where: chat.Local,
+			Run: func(c *chat.Call) (*chat.Result, error) {
+				who, err := cr.findPeer(c.Args)
+				if err != nil {
+					return nil, err
+				}
+				cr.policy.Deny(who)
+				return nil, cr.policy.Save()
+			}},
+		{Name: "/undeny", Args: "<peer>", Help: "lift /deny, /allow rules apply to <peer> again", Where: chat.Local,
+			Run: func(c *chat.Call) (*chat.Result, error) {
+				who, err := cr.findPeer(c.Args)
+				if err != nil {
+					return nil, err
+				}
+				cr.policy.Undeny(who)
+				return nil, cr.policy.Save()
+			}},
+		{Name: "/audit", Args: "[n]", Help: "the last n (20) commands other peers asked of us", Where: chat.Local,
+			Run: func(c *chat.Call) (*chat.Result, error) {
+				n := 20
+				if c.Args != "" {
+					var err error
+					if n, err = strconv.Atoi(c.Args); err != nil || n <= 0 {
+						return nil, fmt.Errorf("usage: /audit [n]")
+					}
+				}
+				var b strings.Builder
+				for _, e := range cr.policy.Audit(n) {
+					fmt.Fprintln(&b, e)
+				}
+				return &chat.Result{Output: b.String()}, nil
+			}},
+		{Name: "/send", Args: "<peer> <file>", Help: "offer <file> to <peer>, sending it once they /accept", Where: chat.Local,
+			Run: func(c *chat.Call) (*chat.Result, error) {
+				to, file, _ := strings.Cut(c.Args, " ")
+				if to == "" || strings.TrimSpace(file) == "" {
+					return nil, fmt.Errorf("usage: /send <peer> <file>")
+				}
+				return output(cr.send(to, strings.TrimSpace(file)))
+			}},
+		{Name: "/accept", Args: "[id]", Help: "take the file offered as id, or the only one offered", Where: chat.Local,
+			Run: func(c *chat.Call) (*chat.Result, error) {
+				id, err := cr.offer(c.Args)
+				if err != nil {
+					return nil, err
+				}
+				return nil, cr.rooms.Accept(id)
+			}},
+		{Name: "/refuse", Args: "[id]", Help: "turn down the file offered as id, or the only one offered", Where: chat.Local,
+			Run: func(c *chat.Call) (*chat.Result, error) {
+				id, err := cr.offer(c.Args)
+				if err != nil {
+					return nil, err
+				}
+				return nil, cr.rooms.Refuse(id)
+			}},
+		{Name: "/quit", Aliases: []string{"/q"}, Help: "leave the chat", Where: chat.Local,
+			Run: func(c *chat.Call) (*chat.Result, error) {
+				cr.quit()
+				return nil, nil
+			}},
+		{Name: "/help", Aliases: []string{"/h"}, Args: "[command]", Help: "this list, or help on one command", Where: chat.Local,
+			Run: func(c *chat.Call) (*chat.Result, error) {
+				return &chat.Result{Output: cr.help(c.Args)}, nil
+			}},
+	}
+}
 
-	switch cmd {
-	case "/who": // /to all /iam - query who is there
-		inject(cr, "/iam", "", "")
-		return nil, errSkip
-	case "/inf": // given as '/in <user>'
-		user := pars
-		inject(cr, "/fetch", user, "this is fixed content")
-		return nil, errSkip
-	case "/fetch": // fetch <addr>, usually called as /to <user> /fetch <addr>
-		// return this as a byte slice, manipulated
-		payload = sampleFetch(pars)
-		*s = "check the json payload\n"
-	case "/to": // formmat /to <addr> message
-		readdr := regexp.MustCompile(`(\S+)\s*(.*)`)
-		reall := regexp.MustCompile(`^all$`)
-		// the single address follows directly, match this with `readLoop`
-		*to = readdr.ReplaceAllString(pars, "$1")
-		*to = reall.ReplaceAllString(*to, "") // fancy way of saying all --> ''
-		*s = fmt.Sprintf("%s\n", readdr.ReplaceAllString(pars, "$2"))
-	case "/peers": // example of a `local command`: never published
-		//            purely for information to the user
-		for _, p := range cr.ListPeers() {
-			fmt.Printf("%v\n", p)
-		}
-		return nil, errSkip
-	case "/iam": // declare my short ID
-		*s = fmt.Sprintf("%s = %s\n", cr.nick, shortID(h.ID()))
-	case "/quit", "/q":
-		cr.quit <- struct{}{}
-	case "/help", "/h":
-		gethelp(pars)
-		return nil, errSkip
-	default:
-		return nil, fmt.Errorf("unknown command: %q", cmd)
+// rule reads the "<command> <peer>" of /allow and /revoke, "all" standing for any
+func (cr *ChatRoom) rule(args string) (string, peer.ID, error) {
+	name, who, _ := strings.Cut(args, " ")
+	who = strings.TrimSpace(who)
+	if name == "" || who == "" {
+		return "", "", fmt.Errorf("need a command and a peer")
+	}
+	if name == "all" {
+		name = chat.AnyCommand
+	} else if !strings.HasPrefix(name, "/") {
+		name = "/" + name
+	}
+	if who == "all" {
+		return name, chat.AnyPeer, nil
+	}
+	id, err := cr.findPeer(who)
+	return name, id, err
+}
+
+// findPeer takes a full peer ID, or the short one of somebody in the room
+func (cr *ChatRoom) findPeer(s string) (peer.ID, error) {
+	if id, err := peer.Decode(s); err == nil {
+		return id, nil
 	}
-	return payload, nil
+	room := cr.rooms.Active()
+	if room == nil {
+		return "", fmt.Errorf("no room to find %q in", s)
+	}
+	return room.FindPeer(s)
 }
 
-// a wrapper for RPCs
-// we use /to <addr> /fetch <stuff> on the command line
-// instead, we have /inj <addr> with preset stuff
-func inject(cr *ChatRoom, cmd, to, content string) {
-	str := fmt.Sprintf("%s %s\n", cmd, content)
-	cr.Publish(str, to, []byte{})
+// output is a Result with out to show, if there is no error
+func output(out string, err error) (*chat.Result, error) {
+	if err != nil {
+		return nil, err
+	}
+	return &chat.Result{Output: out}, nil
+}
+
+// prepare data for pulishing, and what the command has to show: a command
+// with nothing to publish gives errSkip
+func (cr *ChatRoom) handleCommands(s, to *string) ([]byte, string, error) {
+	res, err := cr.registry().Run(*s, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	if res == nil {
+		return nil, "", errSkip
+	}
+	if res.Message == "" {
+		return nil, res.Output, errSkip
+	}
+	*s, *to = res.Message, res.To
+	return res.Payload, res.Output, nil
 }
 
 // typical, json encode the payload
@@ -92,10 +279,3 @@ func sampleFetch(addr string) []byte {
 	bytes, _ := json.Marshal(obj) // ignore errors
 	return bytes
 }
-
-// return the short form of the senderID
-func (cm *ChatMessage) Sender() (sender string) {
-	sender = cm.SenderID
-	sender = sender[len(sender)-8:]
-	return
-}
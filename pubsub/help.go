@@ -1,8 +1,16 @@
 package main
 
-// simply print our item
-func gethelp(it string) {
-	println(help[it])
+import "strings"
+
+// help is our item: a topic, a command, or else the list of commands
+func (cr *ChatRoom) help(it string) string {
+	if text, ok := help[it]; ok {
+		return text + "\n"
+	}
+	if cmd, ok := cr.registry().Lookup("/" + strings.TrimPrefix(it, "/")); ok {
+		return cmd.Usage() + "\t" + cmd.Help + "\n"
+	}
+	return cr.registry().Help()
 }
 
 var help = map[string]string{
@@ -14,7 +22,6 @@ Restart and use a nickname, like so:
 	/quit
 	./chat -nick <yournickname>
 
-type /help for a list of topics.
+type /help for a list of commands.
 -----------------------------`,
-	"": "1. what this app does\n2. flags",
 }
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/bpc2016/p2p/chat"
+	"github.com/libp2p/go-libp2p/core/host"
+)
+
+// the -json mode, for scripts: one JSON object a line on stdout for each
+// thing that happens, and on stdin one JSON op a line, such as
+//
+//	{"op":"publish","room":"lobby","to":"alice","text":"hi"}
+//	{"op":"command","text":"/who","id":"7"}
+//
+// Each op is answered with a result, carrying its id, and for a command
+// what it has to show as text. At startup come a "ready" record, a
+// "status" one if we run offline and an "api" one, with its address and
+// any token made up, for -api. Whatever else gets printed, such as what a
+// /send has to say once done, comes as "output" records.
+
+// record is a line of output
+type record struct {
+	Type  string    `json:"type"`
+	Time  time.Time `json:"time"`
+	ID    string    `json:"id,omitempty"` // the op a result is for
+	Op    string    `json:"op,omitempty"`
+	Room  string    `json:"room,omitempty"`
+	From  string    `json:"from,omitempty"` // a peer ID
+	Nick  string    `json:"nick,omitempty"`
+	To    string    `json:"to,omitempty"`
+	Text  string    `json:"text,omitempty"`
+	Data  []byte    `json:"data,omitempty"`
+	File  string    `json:"file,omitempty"`
+	Addrs []string  `json:"addrs,omitempty"`
+	Token string    `json:"token,omitempty"` // of the API
+	Error string    `json:"error,omitempty"`
+}
+
+// op is a line of input
+type op struct {
+	Op   string `json:"op"` // publish, command, join, leave, nick, status, quit
+	ID   string `json:"id"`
+	Room string `json:"room"`
+	To   string `json:"to"`
+	Text string `json:"text"`
+	Data []byte `json:"data"`
+}
+
+func messageRecord(cm *chat.ChatMessage) *record {
+	return &record{Type: "message", Room: cm.Room, From: cm.SenderID, Nick: cm.SenderNick, To: cm.To,
+		Text: strings.TrimSuffix(cm.Message, "\n")}
+}
+
+func dataRecord(data *chat.ChatData) *record {
+	return &record{Type: "data", Room: data.Room, From: data.SenderID, Nick: data.SenderNick, Data: data.Data, File: data.File}
+}
+
+func eventRecord(ev *chat.Event) *record {
+	r := &record{Type: ev.Type.String(), Room: ev.Room, Text: ev.Text}
+	if ev.Peer != "" {
+		r.From = ev.Peer.String()
+	}
+	if ev.Err != nil {
+		r.Error = ev.Err.Error()
+	}
+	return r
+}
+
+// syncMark starts a line on the pipe that is a record already, not output.
+// Records and output share the pipe, so that they come out in order.
+const syncMark = '\x00'
+
+type jsonMode struct {
+	cr     *ChatRoom
+	stdout *os.File
+	pipeW  *os.File
+	done   chan struct{}
+}
+
+// startJSON has everything printed from now on come out as records, and
+// reads ops from stdin
+func startJSON(cr *ChatRoom, h host.Host) (*jsonMode, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	j := &jsonMode{cr: cr, stdout: os.Stdout, pipeW: w, done: make(chan struct{})}
+	os.Stdout = w
+	go j.readOutput(r)
+
+	ready := &record{Type: "ready", From: h.ID().String(), Nick: cr.nick}
+	for _, addr := range h.Addrs() {
+		ready.Addrs = append(ready.Addrs, fmt.Sprintf("%s/p2p/%s", addr, h.ID()))
+	}
+	j.emit(ready)
+	return j, nil
+}
+
+// Close puts stdout back, once the last of the output is out
+func (j *jsonMode) Close() {
+	os.Stdout = j.stdout
+	j.pipeW.Close()
+	<-j.done
+}
+
+// emit writes r out, through the pipe
+func (j *jsonMode) emit(r *record) {
+	if r.Time.IsZero() {
+		r.Time = time.Now()
+	}
+	b, _ := json.Marshal(r)
+	j.pipeW.Write(append([]byte{syncMark}, append(b, '\n')...))
+}
+
+// readOutput turns what gets printed into records
+func (j *jsonMode) readOutput(r io.Reader) {
+	defer close(j.done)
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadString('\n')
+		if line = strings.TrimSuffix(line, "\n"); line != "" {
+			if line[0] != syncMark {
+				b, _ := json.Marshal(&record{Type: "output", Time: time.Now(), Text: ansiRE.ReplaceAllString(line, "")})
+				line = string(b)
+			} else {
+				line = line[1:]
+			}
+			io.WriteString(j.stdout, line+"\n")
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// result answers an op, after whatever the op printed
+func (j *jsonMode) result(o *op, out string, err error) {
+	r := &record{Type: "result", ID: o.ID, Op: o.Op, Text: strings.TrimSuffix(ansiRE.ReplaceAllString(out, ""), "\n")}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	j.emit(r)
+}
+
+// readOps runs the ops on stdin, one at a time
+func (j *jsonMode) readOps(in io.Reader) {
+	sc := bufio.NewScanner(in)
+	sc.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for sc.Scan() {
+		line := bytes.TrimSpace(sc.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var o op
+		if err := json.Unmarshal(line, &o); err != nil {
+			j.result(&o, "", fmt.Errorf("bad op: %v", err))
+			continue
+		}
+		out, err := j.cr.do(&o)
+		j.result(&o, out, err)
+	}
+	j.cr.quit() // no more input, as good as /quit
+}
+
+// do runs an op
+func (cr *ChatRoom) do(o *op) (string, error) {
+	switch o.Op {
+	case "publish":
+		room, err := cr.room(o.Room)
+		if err != nil {
+			return "", err
+		}
+		return "", room.Publish(o.Text+"\n", o.To, o.Data)
+	case "command":
+		if o.Room != "" {
+			if err := cr.rooms.SetActive(o.Room); err != nil {
+				return "", err
+			}
+		}
+		if !strings.HasPrefix(o.Text, "/") {
+			return "", fmt.Errorf("commands start with /")
+		}
+		return cr.run(o.Text + "\n")
+	case "join":
+		return "", cr.JoinChat(o.Room)
+	case "leave":
+		if o.Room == cr.home {
+			return "", fmt.Errorf("this is home, use the quit op to leave it")
+		}
+		return "", cr.rooms.Leave(o.Room)
+	case "nick":
+		return "", cr.rooms.SetNick(o.Text)
+	case "status":
+		return "", cr.rooms.SetStatus(o.Text)
+	case "quit":
+		cr.quit()
+		return "", nil
+	}
+	return "", fmt.Errorf("unknown op %q", o.Op)
+}
+
+// room is the room called name, the active one if name is empty
+func (cr *ChatRoom) room(name string) (*chat.ChatRoom, error) {
+	if name == "" {
+		if room := cr.rooms.Active(); room != nil {
+			return room, nil
+		}
+		return nil, fmt.Errorf("not in any room")
+	}
+	if room, ok := cr.rooms.Room(name); ok {
+		return room, nil
+	}
+	return nil, fmt.Errorf("not in %s, join it first", name)
+}
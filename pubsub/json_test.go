@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/bpc2016/p2p/chat"
+)
+
+func TestJSONMode(t *testing.T) {
+	sr, sw, err := os.Pipe() // stands in for stdout
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	j := &jsonMode{cr: &ChatRoom{quit: func() {}}, stdout: sw, pipeW: w, done: make(chan struct{})}
+	go j.readOutput(r)
+
+	fmt.Fprintln(w, "hello \x1b[32mworld\x1b[0m")
+	j.readOps(strings.NewReader("{bad\n\n{\"op\":\"dance\",\"id\":\"7\"}\n{\"op\":\"command\",\"id\":\"8\",\"text\":\"/help /who\"}\n"))
+	j.cr.json = j
+	j.cr.warn("mdns", fmt.Errorf("no multicast"))
+	j.cr.notice(&record{Type: "api", Addrs: []string{"127.0.0.1:8080"}, Token: "t0ken"}, "API token: t0ken")
+	j.emit(messageRecord(&chat.ChatMessage{Message: "hi\n", SenderNick: "bob", Room: "lobby"}))
+	w.Close()
+	<-j.done
+	sw.Close()
+
+	out, err := io.ReadAll(sr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []record
+	dec := json.NewDecoder(strings.NewReader(string(out)))
+	for dec.More() {
+		var rec record
+		if err := dec.Decode(&rec); err != nil {
+			t.Fatalf("%v in %s", err, out)
+		}
+		got = append(got, rec)
+	}
+	if len(got) != 7 {
+		t.Fatalf("want 7 records, got %s", out)
+	}
+	if got[0].Type != "output" || got[0].Text != "hello world" {
+		t.Errorf("output: %+v", got[0])
+	}
+	if got[1].Type != "result" || !strings.Contains(got[1].Error, "bad op") {
+		t.Errorf("bad op: %+v", got[1])
+	}
+	if got[2].Type != "result" || got[2].ID != "7" || !strings.Contains(got[2].Error, "unknown op") {
+		t.Errorf("unknown op: %+v", got[2])
+	}
+	// what a command has to show comes with its result, not as output
+	if got[3].Type != "result" || got[3].ID != "8" || got[3].Op != "command" || got[3].Error != "" || !strings.HasPrefix(got[3].Text, "/who\t") {
+		t.Errorf("command: %+v", got[3])
+	}
+	if got[4].Type != "error" || got[4].Text != "mdns" || got[4].Error != "no multicast" {
+		t.Errorf("warning: %+v", got[4])
+	}
+	if got[5].Type != "api" || got[5].Token != "t0ken" || len(got[5].Addrs) != 1 {
+		t.Errorf("api: %+v", got[5])
+	}
+	if got[6].Type != "message" || got[6].Text != "hi" || got[6].Nick != "bob" || got[6].Room != "lobby" {
+		t.Errorf("message: %+v", got[6])
+	}
+}
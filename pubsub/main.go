@@ -6,18 +6,20 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
-	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"regexp"
-	"sync"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/bpc2016/p2p/chat"
+	"github.com/bpc2016/p2p/identity"
+	"github.com/bpc2016/p2p/metrics"
 	"github.com/libp2p/go-libp2p"
-	dht "github.com/libp2p/go-libp2p-kad-dht"
-	pubsub "github.com/libp2p/go-libp2p-pubsub"
 	"github.com/libp2p/go-libp2p/core/host"
-	"github.com/libp2p/go-libp2p/core/peer"
-	drouting "github.com/libp2p/go-libp2p/p2p/discovery/routing"
-	dutil "github.com/libp2p/go-libp2p/p2p/discovery/util"
+	"github.com/libp2p/go-libp2p/p2p/discovery/mdns"
 )
 
 type application struct {
@@ -28,17 +30,59 @@ type application struct {
 var my application
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "identity" {
+		if err := identity.Command(os.Args[0], os.Args[2:], os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	debugF := flag.Bool("d", false, "debug")
 	portF := flag.Int("p", 0, "port to use")
+	keyF := flag.String("key", "", "file keeping our identity, created if missing; empty for a new one each run. see the identity subcommand")
 	nickF := flag.String("nick", "", "nickname to use in chat. will be generated if empty")
-	roomF := flag.String("room", "akumuji", "name of chat room to join")
+	roomF := flag.String("room", chat.DefaultRoom, "name of chat room to join, or a comma separated list of them: the first is home")
+	bootF := flag.String("bootstrap", "default", "comma separated bootstrap peer multiaddrs, 'default' for the public ones, 'none' to run without")
+	connectF := flag.String("connect", "", "comma separated multiaddrs of peers to dial at startup")
+	mdnsF := flag.Bool("mdns", true, "find peers on the local network with mDNS")
+	maxSizeF := flag.Int("max-size", chat.DefaultLimits.MaxSize, "largest message, in bytes, accepted in a room")
+	rateF := flag.Float64("rate", chat.DefaultLimits.Rate, "messages a second accepted from each peer")
+	burstF := flag.Int("burst", chat.DefaultLimits.Burst, "messages accepted from a peer in one go")
+	historyF := flag.String("history", defaultHistory(), "directory to keep room history in, empty for none")
+	aclF := flag.String("acl", defaultFile("acl.json"), "file keeping who may run which commands here, empty to forget on exit")
+	remoteF := flag.String("remote", "", "comma separated commands anyone may run here, on top of -acl; none unless given, -remote /iam lets peers ask who we are")
+	downloadsF := flag.String("downloads", defaultFile("downloads"), "directory to keep files we /accept in, empty to take none")
+	maxDownloadF := flag.Int64("max-download", chat.DefaultMaxDownload, "largest file, in bytes, we may be offered")
+	auditF := flag.String("audit", defaultFile("audit.log"), "file logging every remote command, empty for none")
+	tuiF := flag.Bool("tui", false, "full screen: room tabs, roster and status bar; the plain line mode otherwise")
+	apiF := flag.String("api", "", "local address, such as 127.0.0.1:8080, to serve the HTTP and WebSocket API on, see api.go")
+	apiTokenF := flag.String("api-token", os.Getenv("P2P_API_TOKEN"), "token the API wants, one is made up (and shown) if empty")
+	apiOriginF := flag.String("api-origin", "", "comma separated origins, host patterns such as localhost:3000 or *.example.com, whose web pages may use the API")
+	metricsF := flag.String("metrics", "", "address to serve Prometheus metrics on, at /metrics, such as 127.0.0.1:9101; empty for none")
+	jsonF := flag.Bool("json", false, "for scripts: JSON records out, a line each, and JSON ops in, see json.go")
 
 	flag.Parse()
-	ctx := context.Background()
+	if *tuiF && *jsonF {
+		fmt.Fprintln(os.Stderr, "-tui or -json, not both")
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	// ctx lives as long as the host does; ^C, SIGTERM or /quit end sig, and
+	// with it the chat, but shutdown still has the host to say goodbye with
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sig, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	// this app requires internet connectivity
-	if !connected() {
-		panic("check your internet connection")
+	bootstrap, err := chat.ParseBootstrap(*bootF)
+	if err != nil {
+		panic(err)
+	}
+	direct, err := chat.ParseAddrs(*connectF)
+	if err != nil {
+		panic(err)
 	}
 
 	// setup the appllication
@@ -48,13 +92,41 @@ func main() {
 	}
 
 	listener := fmt.Sprintf("/ip4/0.0.0.0/tcp/%d", *portF)
-	h, err := libp2p.New(libp2p.ListenAddrStrings(listener))
+	id, err := identity.Option(*keyF)
 	if err != nil {
 		panic(err)
 	}
+	h, err := libp2p.New(libp2p.ListenAddrStrings(listener), id)
+	if err != nil {
+		panic(err)
+	}
+	if !*jsonF { // the ready record has them
+		for _, addr := range h.Addrs() { // for other peers' -connect
+			fmt.Printf("I am: %s/p2p/%s\n", addr, h.ID())
+		}
+	}
 
 	// subscription is the 1st thing: done by the host
-	ps, err := pubsub.NewGossipSub(ctx, h)
+	// the mesh is watched for -metrics
+	mesh := chat.NewMesh()
+	ps, err := chat.NewGossipSub(ctx, h, mesh.Option())
+	if err != nil {
+		panic(err)
+	}
+
+	// peers on the LAN, or named on the command line, need no bootstrapping
+	var lan mdns.Service
+	var mdnsErr error // told once -json or -tui have the output
+	if *mdnsF {
+		lan, mdnsErr = chat.StartMDNS(ctx, h)
+	}
+	chat.Connect(ctx, h, direct)
+
+	// one DHT serves every room we join
+	disc, err := chat.NewDHTDiscovery(ctx, h, bootstrap)
+	if err == chat.ErrUnreachable {
+		panic("check your internet connection, or use -bootstrap none")
+	}
 	if err != nil {
 		panic(err)
 	}
@@ -62,147 +134,257 @@ func main() {
 	// use the nickname from the cli flag, or a default if blank
 	nick := *nickF
 	if len(nick) == 0 {
-		nick = defaultNick(h.ID())
+		nick = chat.DefaultNick(h.ID())
 	}
 
 	// cr defined here so that we can easily move to another
+	roomNames := strings.Split(*roomF, ",")
 	cr := ChatRoom{
-		ctx:  ctx,
-		ps:   ps,
-		self: h.ID(),
+		h:    h,
 		nick: nick,
-		home: *roomF,
-		quit: make(chan struct{}),
+		home: strings.TrimSpace(roomNames[0]),
+		quit: stop,
 	}
-
-	// joining room = *roomF takes care of topic,
-	// now includes discovery, hence the h
-	if err := cr.JoinChat(h, *roomF); err != nil {
+	if cr.policy, err = chat.LoadPolicy(*aclF); err != nil {
+		panic(err)
+	}
+	for _, name := range strings.Split(*remoteF, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			cr.policy.Allow(name, chat.AnyPeer)
+		}
+	}
+	if *auditF != "" {
+		audit, err := os.OpenFile(*auditF, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			panic(err)
+		}
+		defer audit.Close()
+		cr.policy.SetAuditLog(audit)
+	}
+	cr.registry().SetPolicy(cr.policy)
+	opts := []chat.Option{
+		chat.WithHost(h),
+		chat.WithPubSub(ps),
+		chat.WithNick(nick),
+		chat.WithDiscovery(disc),
+		chat.WithCommands(cr.registry().Handler()),
+		chat.WithLimits(chat.Limits{MaxSize: *maxSizeF, Rate: *rateF, Burst: *burstF}),
+		chat.WithDownloads(*downloadsF),
+		chat.WithMaxDownload(*maxDownloadF),
+		chat.WithMesh(mesh),
+	}
+	if *historyF != "" {
+		if cr.history, err = chat.OpenHistory(*historyF); err != nil {
+			panic(err)
+		}
+		opts = append(opts, chat.WithHistory(cr.history))
+	}
+	cr.rooms, err = chat.NewManager(ctx, opts...)
+	if err != nil {
 		panic(err)
 	}
 
-	cr.homeTopic = cr.topic // keep this one, for use by the `.home` command
+	if *metricsF != "" {
+		srv, err := metrics.Serve(*metricsF, metrics.Chat(cr.rooms))
+		if err != nil {
+			panic(err)
+		}
+		defer srv.Close()
+	}
 
-	println("You have to be online for this to work!")
+	// joining each room takes care of topic,
+	// now includes discovery. we end up talking at home
+	for i := len(roomNames) - 1; i >= 0; i-- {
+		if err := cr.JoinChat(strings.TrimSpace(roomNames[i])); err != nil {
+			panic(err)
+		}
+	}
 
-	// welcome
-	gethelp("0")
+	// the full screen takes over stdin, and whatever we print
+	var ui *tui
+	if *tuiF {
+		if ui, err = startTUI(&cr, h); err != nil {
+			panic(err)
+		}
+	}
 
-	// loop that prints responses, user send message `/quit` to quit
-	cr.printMessagesFrom(h) // h so that we can use JoinChat
-}
+	// or we talk JSON, till the very end
+	if *jsonF {
+		if cr.json, err = startJSON(&cr, h); err != nil {
+			panic(err)
+		}
+		defer cr.json.Close()
+		go cr.json.readOps(os.Stdin)
+	} else {
+		// welcome
+		fmt.Print(cr.help("0"))
+	}
+	if mdnsErr != nil {
+		cr.warn("mdns", mdnsErr)
+	}
+	if len(bootstrap) == 0 {
+		cr.notice(&record{Type: "status", Text: "offline: peers come from -connect and the local network"},
+			"Running offline: peers come from -connect and the local network")
+	}
 
-//---------------  tools -------------
+	// the API, for those who would rather not speak libp2p
+	if *apiF != "" {
+		token, shown := *apiTokenF, ""
+		started := &record{Type: "api", Addrs: []string{*apiF}}
+		if token == "" {
+			token = newToken()
+			started.Token, shown = token, "API token: "+token
+		}
+		var origins []string
+		for _, o := range strings.Split(*apiOriginF, ",") {
+			if o = strings.TrimSpace(o); o != "" {
+				origins = append(origins, o)
+			}
+		}
+		if cr.api, err = startAPI(&cr, *apiF, token, origins); err != nil {
+			panic(err)
+		}
+		defer cr.api.Close()
+		cr.notice(started, shown)
+	}
 
-// check if we have a live internete connection
-func connected() bool {
-	if _, err := http.Get("http://clients3.google.com/generate_204"); err != nil {
-		return false
+	// write message
+	if ui == nil && cr.json == nil {
+		go cr.streamConsoleTo(h)
 	}
-	return true
-}
 
-// my own println - replace a verbiage with x
-func (my *application) Println(x string, a ...any) (n int, err error) {
-	if my.debug {
-		return fmt.Println(a...)
+	// loop that prints responses, user send message `/quit` to quit
+	cr.printMessagesFrom(sig)
+
+	// a second ^C no longer waits for us
+	stop()
+	if ui != nil {
+		ui.Close()
+	}
+	fmt.Println("leaving ...")
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		cr.rooms.Close() // says goodbye, and stops discovery in each room
+		if lan != nil {
+			lan.Close()
+		}
+		disc.Close()
+		if cr.history != nil {
+			cr.history.Close()
+		}
+		h.Close()
+	}()
+	select {
+	case <-done:
+	case <-time.After(shutdownTimeout):
+		fmt.Println("gave up waiting, bye")
 	}
-	return fmt.Print(x) // just replace with these
 }
 
-// called by discoverPeers
-func initDHT(ctx context.Context, h host.Host) *dht.IpfsDHT {
-	// Start a DHT, for use in peer discovery. We can't just make a new DHT
-	// client because we want each peer to maintain its own local copy of the
-	// DHT, so that the bootstrapping node of the DHT can go down without
-	// inhibiting future peer discovery.
-	kademliaDHT, err := dht.New(ctx, h)
+// shutdownTimeout is how long we wait for goodbyes and the like on the way out
+const shutdownTimeout = 5 * time.Second
+
+//---------------  tools -------------
+
+// defaultHistory is where history goes unless -history says otherwise
+func defaultHistory() string {
+	home, err := os.UserHomeDir()
 	if err != nil {
-		panic(err)
+		return ""
 	}
-	if err = kademliaDHT.Bootstrap(ctx); err != nil {
-		panic(err)
+	return filepath.Join(home, ".p2pchat", "history")
+}
+
+// defaultFile is where name goes, next to the history, unless a flag says otherwise
+func defaultFile(name string) string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
 	}
-	var wg sync.WaitGroup
-	for _, peerAddr := range dht.DefaultBootstrapPeers {
-		peerinfo, _ := peer.AddrInfoFromP2pAddr(peerAddr)
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			if err := h.Connect(ctx, *peerinfo); err != nil {
-				fmt.Println("Bootstrap warning:", err)
-			}
-		}()
+	dir := filepath.Join(home, ".p2pchat")
+	if os.MkdirAll(dir, 0700) != nil {
+		return ""
 	}
-	wg.Wait()
-
-	return kademliaDHT
+	return filepath.Join(dir, name)
 }
 
-// use topic from the chatroot, could have also been set as a parameter
-func (cr *ChatRoom) discoverPeers(ctx context.Context, h host.Host) {
-	kademliaDHT := initDHT(ctx, h)
-	routingDiscovery := drouting.NewRoutingDiscovery(kademliaDHT)
-	topicname := cr.topic.String()
-	dutil.Advertise(ctx, routingDiscovery, topicname)
-
-	// Look for others who have announced and attempt to connect to them
-	anyConnected := false
-	for !anyConnected {
-		my.Println("\n", "Searching for peers...")
-		peerChan, err := routingDiscovery.FindPeers(ctx, topicname)
-		if err != nil {
-			panic(err)
-		}
-		for peer := range peerChan {
-			if peer.ID == h.ID() {
-				continue // No self connection
-			}
-			err := h.Connect(ctx, peer)
-			if err != nil {
-				my.Println("-", "Failed connecting to ", peer.ID.String(), ", error:", err)
-			} else {
-				my.Println("\n@\n", "Connected to:", peer.ID.String())
-				anyConnected = true
-			}
-		}
+// my own println - replace a verbiage with x
+func (my *application) Println(x string, a ...any) (n int, err error) {
+	if my.debug {
+		return fmt.Println(a...)
 	}
-	my.Println("\nPeer discovery complete\n\n", "Peer discovery complete")
+	return fmt.Print(x) // just replace with these
 }
 
 // capture keystrokes and produce messages
 // ctx and topic taken care of by chatroom
 func (cr *ChatRoom) streamConsoleTo(h host.Host) {
-	// we handle commands separately
-	// this leads directly to publishing
-	reloc := regexp.MustCompile("^/")
-
 	reader := bufio.NewReader(os.Stdin)
 	for {
 		s, err := reader.ReadString('\n')
 		if err != nil {
-			panic(err)
+			cr.quit() // no more input, as good as /quit
+			return
 		}
-		//in case we have private messages
-		to := ""            // default: public
-		payload := []byte{} // empty
+		cr.input(s)
+	}
+}
 
-		if reloc.MatchString(s) {
-			p, err := cr.handleCommands(&s, &to, h)
-			if err != nil {
-				if err != errSkip {
-					fmt.Printf("%v\n", err)
-				}
-				continue
-			}
-			payload = p
-		}
+// we handle commands separately
+// this leads directly to publishing
+var reloc = regexp.MustCompile("^/")
 
-		// publish
-		if err := cr.Publish(s, to, payload); err != nil {
-			panic(err)
+// input acts on a line typed, in line mode or in the full screen
+func (cr *ChatRoom) input(s string) {
+	out, err := cr.run(s)
+	fmt.Print(out)
+	if err != nil {
+		fmt.Printf("%v\n", err)
+	}
+}
+
+// warn tells of something that went wrong but does not stop us, as an
+// error record in -json mode
+func (cr *ChatRoom) warn(what string, err error) {
+	if cr.json != nil {
+		cr.json.emit(&record{Type: "error", Text: what, Error: err.Error()})
+		return
+	}
+	fmt.Printf("%s warning: %v\n", what, err)
+}
+
+// notice tells how we run: r in -json mode, line (if any) otherwise
+func (cr *ChatRoom) notice(r *record, line string) {
+	if cr.json != nil {
+		cr.json.emit(r)
+		return
+	}
+	if line != "" {
+		fmt.Println(line)
+	}
+}
+
+// run is what a line does: a command, or a message to publish. out is
+// what a command has to show.
+func (cr *ChatRoom) run(s string) (out string, err error) {
+	//in case we have private messages
+	to := ""            // default: public
+	payload := []byte{} // empty
+
+	if reloc.MatchString(s) {
+		p, out, err := cr.handleCommands(&s, &to)
+		if err == errSkip {
+			return out, nil
 		}
+		if err != nil {
+			return out, err
+		}
+		payload = p
+		// publish, private messages can miss their target
+		return out, cr.Publish(s, to, payload)
 	}
+	return "", cr.Publish(s, to, payload)
 }
 
 /*
@@ -215,7 +397,8 @@ func (cr *ChatRoom) OldstreamConsoleTo(h host.Host) {
 	for {
 		s, err := reader.ReadString('\n')
 		if err != nil {
-			panic(err)
+			cr.quit() // no more input, as good as /quit
+			return
 		}
 		if reloc.MatchString(s) {
 			fmt.Printf("skipping this: %q\n", s)
@@ -240,28 +423,104 @@ func (cr *ChatRoom) OldstreamConsoleTo(h host.Host) {
 func printLine(from, msg string) (n int, err error) {
 	// Green console colour: 	\x1b[32m
 	// Reset console colour: 	\x1b[0m
-	return fmt.Printf("\x1b[32m%s\x1b[0m: %s", from, msg)
+	return fmt.Print(colourLine(from, msg))
+}
+
+// colourLine is msg from from, as printLine has it
+func colourLine(from, msg string) string {
+	return fmt.Sprintf("\x1b[32m%s\x1b[0m: %s", from, msg)
 }
 
 // for multiplexed chat usage - use with readloop
 // this is the final routine in `main`, so breaking
 // out of the loop terminates the whole app
-func (cr *ChatRoom) printMessagesFrom(h host.Host) {
+func (cr *ChatRoom) printMessagesFrom(ctx context.Context) {
 OUT:
 	for {
 		select {
-		case cm := <-cr.Messages:
-			printLine(cm.SenderNick, cm.Message)
+		case cm := <-cr.rooms.Messages:
+			if cr.api != nil {
+				cr.api.broadcast(messageRecord(cm))
+			}
+			if cr.json != nil {
+				cr.json.emit(messageRecord(cm))
+				continue
+			}
+			from := cm.From()
+			if cm.To != "" {
+				from += " (private)"
+			}
+			printLine(cr.tag(cm.Room, from), cm.Message)
+
+		case data := <-cr.rooms.Data: // this data can be used elsewhere
+			if cr.api != nil {
+				cr.api.broadcast(dataRecord(data))
+			}
+			if cr.json != nil {
+				cr.json.emit(dataRecord(data))
+				continue
+			}
+			if data.File != "" {
+				printLine(cr.tag(data.Room, data.From()), fmt.Sprintf("sent us %s\n", data.File))
+				continue
+			}
+			printLine(cr.tag(data.Room, data.From()), fmt.Sprintf("%s\n", string(data.Data)))
 
-		case data := <-cr.Data: // this data can be used elsewhere
-			printLine(data.SenderNick, fmt.Sprintf("%s\n", string(data.Data)))
+		case ev := <-cr.rooms.Events:
+			if cr.json != nil {
+				cr.json.emit(eventRecord(ev))
+				continue
+			}
+			printEvent(ev)
 
-		case <-cr.quit:
+		case <-ctx.Done():
 			break OUT
 		}
 	}
 }
 
+// tag says which room `from` is talking in, if we are in more than one
+func (cr *ChatRoom) tag(room, from string) string {
+	if len(cr.rooms.Rooms()) < 2 {
+		return from
+	}
+	return fmt.Sprintf("[%s] %s", room, from)
+}
+
+// printEvent shows what goes on in the room, tersely unless debugging
+func printEvent(ev *chat.Event) {
+	switch ev.Type {
+	case chat.EventSearching:
+		my.Println("\n", ev.Text)
+	case chat.EventConnectFailed:
+		my.Println("-", "Failed connecting to ", ev.Peer.String(), ", error:", ev.Err)
+	case chat.EventConnected:
+		my.Println("\n@\n", "Connected to:", ev.Peer.String())
+	case chat.EventDiscoveryDone:
+		my.Println("\nPeer discovery complete\n\n", ev.Text)
+	case chat.EventError:
+		fmt.Printf("%v\n", ev)
+	case chat.EventRejected:
+		my.Println("", fmt.Sprintf("%v\n", ev))
+	case chat.EventCaughtUp:
+		fmt.Printf("caught up on %s in %s\n", ev.Text, ev.Room)
+	case chat.EventOffer:
+		fmt.Printf("file offered: %s, /accept or /refuse it\n", ev.Text)
+	case chat.EventProgress:
+		fmt.Printf("%s\n", ev.Text)
+	case chat.EventJoin:
+		fmt.Printf("%s~%s has joined %s\n", ev.Text, chat.ShortID(ev.Peer), ev.Room)
+	case chat.EventLeave:
+		fmt.Printf("%s~%s has left %s\n", ev.Text, chat.ShortID(ev.Peer), ev.Room)
+	case chat.EventNick:
+		if ev.Err != nil {
+			fmt.Printf("careful, %v\n", ev)
+			break
+		}
+		fmt.Printf("%s\n", ev.Text)
+	}
+}
+
 /*
 // for multiplexed chat usage - use with readloop
 func (cr *ChatRoom) OldprintMessagesFrom(h host.Host) {
@@ -286,18 +545,6 @@ OUT:
 }
 */
 
-// defaultNick generates a nickname based on the $USER environment variable and
-// the last 8 chars of a peer ID.
-func defaultNick(p peer.ID) string {
-	return fmt.Sprintf("%s-%s", os.Getenv("USER"), shortID(p))
-}
-
-// shortID returns the last 8 chars of a base58-encoded peer id.
-func shortID(p peer.ID) string {
-	pretty := p.String()
-	return pretty[len(pretty)-8:]
-}
-
 // PrintJSON gives a pretty representation
 // of the contents of struct variable <c>
 func PrintJSON(c interface{}) error {
@@ -305,6 +552,6 @@ func PrintJSON(c interface{}) error {
 	if err != nil {
 		return fmt.Errorf("jsonisplay MarshalIndent: %v", err)
 	}
-	println(string(toSend))
+	fmt.Println(string(toSend))
 	return nil
 }
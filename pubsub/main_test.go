@@ -1,11 +1,15 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"regexp"
 	"strings"
 	"testing"
+
+	"github.com/bpc2016/p2p/chat"
+	"github.com/libp2p/go-libp2p"
 )
 
 // so that we can use app.applications here, invoke db
@@ -45,7 +49,7 @@ func TestHandleC(t *testing.T) {
 		ss := test.s // handle modifies this!
 		// handle converts test.s --> test.cm
 		tto := "" // ditto
-		cr.handleCommands(&ss, &tto, nil)
+		cr.handleCommands(&ss, &tto)
 		if ss != test.cm {
 			t.Errorf("cm - handlecmnds, with cmd string (%q) = %q, wanted %q", test.s, ss, test.cm)
 		}
@@ -74,13 +78,13 @@ func inside(cmMessage, cmPayload string, cr *ChatRoom) (string, string, error) {
 
 		// fmt.Printf("\tseeing msg %q with payload %q\n", cmMessage, cmPayload)
 
-		if !cr.validCommand(cmMessage) {
+		if !cr.registry().Valid(cmMessage, true) {
 			// fmt.Printf("\tinvalid commands : %q\n", cmMessage)
 			return "", "", fmt.Errorf("invalid commands : %q", cmMessage)
 		}
 		cmTo := ""
 		// prep, if there is a payload, it is in cm.Payload
-		if _, err := cr.handleCommands(&cmMessage, &cmTo, nil); err != nil {
+		if _, _, err := cr.handleCommands(&cmMessage, &cmTo); err != nil {
 			//fmt.Printf("\thandlecomands error: %v\n", err)
 			return "", "", fmt.Errorf("handlecomands error: %v", err)
 			//return err
@@ -123,7 +127,7 @@ func TestSample(t *testing.T) {
 		// test handlecommands
 		ss := test.s   // handle modifies this!
 		tto := test.to // ditto
-		p, err := cr.handleCommands(&ss, &tto, nil)
+		p, _, err := cr.handleCommands(&ss, &tto)
 		if err != nil {
 			t.Errorf("handlecmnds, with cmd string (%q) = %v, wanted %v", test.s, err, nil)
 		}
@@ -142,7 +146,7 @@ func TestSample(t *testing.T) {
 		}
 		// mock the transmitted info, first have the message structure,
 		// look at cr.Publish
-		m := ChatMessage{
+		m := chat.ChatMessage{
 			Message:    test.cm,
 			To:         tto,
 			Payload:    p,
@@ -154,7 +158,7 @@ func TestSample(t *testing.T) {
 			t.Errorf("json marshal error %q", err)
 		}
 		// which is consumed by readLoop
-		cm := new(ChatMessage)
+		cm := new(chat.ChatMessage)
 		err = json.Unmarshal(msgBytes, cm)
 		if err != nil {
 			t.Errorf("json Unmarshal error %q", err)
@@ -171,6 +175,56 @@ func TestSample(t *testing.T) {
 	}
 }
 
+// roomsSetup gives a ChatRoom at home in "lobby", on a host nobody can reach
+func roomsSetup(t *testing.T) *ChatRoom {
+	h, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { h.Close() })
+	cr := &ChatRoom{h: h, nick: "me", home: "lobby", quit: func() {}}
+	cr.rooms, err = chat.NewManager(context.Background(), chat.WithHost(h), chat.WithNick("me"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { cr.rooms.Close() })
+	if err := cr.JoinChat("lobby"); err != nil {
+		t.Fatal(err)
+	}
+	return cr
+}
+
+func TestRooms(t *testing.T) {
+	cr := roomsSetup(t)
+
+	var tests = []struct {
+		s      string // command
+		rooms  string // listRooms afterwards
+		failed bool
+	}{
+		{"/join kitchen\n", "*kitchen lobby", false},
+		{"/join garden\n", "*garden lobby", false}, // kitchen is left behind
+		{"/join garden\n", "*garden lobby", true},
+		{"/home\n", "*lobby", false},
+		{"/leave\n", "*lobby", true}, // can't leave home
+		{"/join attic\n", "*attic lobby", false},
+		{"/leave\n", "*lobby", false},
+		{"/room\n", "*lobby", false},
+		{"/room attic\n", "*lobby", true},
+		{"/join\n", "*lobby", true},
+	}
+	for _, test := range tests {
+		ss, to := test.s, ""
+		_, _, err := cr.handleCommands(&ss, &to)
+		if failed := err != errSkip; failed != test.failed {
+			t.Errorf("handlecmnds (%q) error = %v, wanted failure: %v", test.s, err, test.failed)
+		}
+		if got := cr.listRooms(); got != test.rooms {
+			t.Errorf("rooms after (%q) = %q, wanted %q", test.s, got, test.rooms)
+		}
+	}
+}
+
 func console(s *string, cr *ChatRoom) error {
 	reloc := regexp.MustCompile("^/") //(`^\/`)
 
@@ -181,7 +235,7 @@ func console(s *string, cr *ChatRoom) error {
 	fmt.Printf("command string s: %q\n", *s)
 
 	if reloc.MatchString(*s) {
-		p, err := cr.handleCommands(s, &to, nil)
+		p, _, err := cr.handleCommands(s, &to)
 		if err != nil {
 			if err != errSkip {
 				fmt.Printf("%v\n", err)
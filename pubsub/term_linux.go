@@ -0,0 +1,9 @@
+package main
+
+import "golang.org/x/sys/unix"
+
+// the requests that get and set the terminal's settings, see makeRaw
+const (
+	ioctlGetTermios = unix.TCGETS
+	ioctlSetTermios = unix.TCSETS
+)
@@ -0,0 +1,20 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+var resizeSignals []os.Signal
+
+var errNoTUI = errors.New("the full screen mode needs linux, macOS or a BSD, leave out -tui")
+
+func makeRaw(fd int) (restore func(), err error) {
+	return nil, errNoTUI
+}
+
+func termSize(fd int) (int, int, error) {
+	return 0, 0, errNoTUI
+}
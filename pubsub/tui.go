@@ -0,0 +1,443 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/signal"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/bpc2016/p2p/chat"
+	"github.com/libp2p/go-libp2p/core/host"
+)
+
+// the full screen mode (-tui): room tabs on top, messages with the room's
+// roster beside them, a status bar, and an input line nothing else writes
+// on. Whatever the rest of the program prints lands in the message pane.
+
+const (
+	tuiKeep      = 1000 // lines of scrollback
+	sidebarWidth = 26
+	tuiRefresh   = time.Second
+	tuiQueue     = 32 // typed lines waiting for those before them
+)
+
+var ansiRE = regexp.MustCompile("\x1b\\[[0-9;?]*[A-Za-z]")
+
+type tui struct {
+	cr *ChatRoom
+	h  host.Host
+
+	term    *os.File // the real terminal, now that os.Stdout is the pipe
+	stdout  *os.File
+	stderr  *os.File
+	pipeW   *os.File
+	restore func()
+	stop    chan struct{}
+	typed   chan string // for runTyped, so that keys never wait on the network
+
+	mu     sync.Mutex
+	lines  []string
+	scroll int // how many lines up from the bottom we are looking
+	input  []rune
+	cursor int
+	past   []string // what we typed, for up and down
+	pastAt int
+}
+
+// startTUI takes over the terminal. Typed lines go where streamConsoleTo
+// sends them; Close gives the terminal back.
+func startTUI(cr *ChatRoom, h host.Host) (*tui, error) {
+	restore, err := makeRaw(int(os.Stdin.Fd()))
+	if err != nil {
+		return nil, fmt.Errorf("-tui: %v", err)
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		restore()
+		return nil, err
+	}
+	ui := &tui{
+		cr:      cr,
+		h:       h,
+		term:    os.Stdout,
+		stdout:  os.Stdout,
+		stderr:  os.Stderr,
+		pipeW:   w,
+		restore: restore,
+		stop:    make(chan struct{}),
+		typed:   make(chan string, tuiQueue),
+	}
+	os.Stdout, os.Stderr = w, w
+	fmt.Fprint(ui.term, "\x1b[?1049h") // the alternate screen, our own
+
+	go ui.readOutput(r)
+	go ui.readKeys()
+	go ui.runTyped()
+	go ui.refresh()
+	ui.draw()
+	return ui, nil
+}
+
+// Close leaves the full screen, the terminal is as we found it
+func (ui *tui) Close() {
+	ui.mu.Lock()
+	close(ui.stop)
+	ui.mu.Unlock()
+	os.Stdout, os.Stderr = ui.stdout, ui.stderr
+	ui.pipeW.Close()
+	fmt.Fprint(ui.term, "\x1b[?25h\x1b[?1049l")
+	ui.restore()
+}
+
+// readOutput puts what gets printed in the message pane
+func (ui *tui) readOutput(r *os.File) {
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		ui.mu.Lock()
+		ui.lines = append(ui.lines, ansiRE.ReplaceAllString(sc.Text(), ""))
+		if len(ui.lines) > tuiKeep {
+			ui.lines = ui.lines[len(ui.lines)-tuiKeep:]
+		}
+		ui.mu.Unlock()
+		ui.draw()
+	}
+}
+
+// runTyped does what was typed, in order. A private message or a file
+// takes a while, typing goes on meanwhile.
+func (ui *tui) runTyped() {
+	for {
+		select {
+		case line := <-ui.typed:
+			ui.cr.input(line)
+		case <-ui.stop:
+			return
+		}
+	}
+}
+
+// refresh redraws now and then, for the roster and status, and on resizing
+func (ui *tui) refresh() {
+	resized := make(chan os.Signal, 1)
+	if len(resizeSignals) > 0 {
+		signal.Notify(resized, resizeSignals...)
+		defer signal.Stop(resized)
+	}
+	ticker := time.NewTicker(tuiRefresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-resized:
+		case <-ui.stop:
+			return
+		}
+		ui.draw()
+	}
+}
+
+func (ui *tui) readKeys() {
+	buf := make([]byte, 256)
+	for {
+		n, err := os.Stdin.Read(buf)
+		if err != nil {
+			ui.cr.quit()
+			return
+		}
+		for _, k := range parseKeys(buf[:n]) {
+			if !ui.key(k) {
+				return
+			}
+		}
+		ui.draw()
+	}
+}
+
+// key is a key pressed: a rune typed, or the name of some other key
+type key struct {
+	r    rune
+	name string
+}
+
+var csiKeys = map[string]string{
+	"A": "up", "B": "down", "C": "right", "D": "left",
+	"H": "home", "F": "end", "3~": "delete", "5~": "pgup", "6~": "pgdn",
+}
+
+// parseKeys makes keys of what the terminal sends in raw mode
+func parseKeys(b []byte) []key {
+	var keys []key
+	for len(b) > 0 {
+		if b[0] == 0x1b && len(b) > 2 && b[1] == '[' {
+			end := 2
+			for end < len(b) && (b[end] < 0x40 || b[end] > 0x7e) {
+				end++
+			}
+			if end < len(b) {
+				keys = append(keys, key{name: csiKeys[string(b[2:end+1])]})
+				b = b[end+1:]
+				continue
+			}
+		}
+		r, n := utf8.DecodeRune(b)
+		b = b[n:]
+		switch r {
+		case 3:
+			keys = append(keys, key{name: "ctrl-c"})
+		case 4:
+			keys = append(keys, key{name: "ctrl-d"})
+		case '\t':
+			keys = append(keys, key{name: "tab"})
+		case '\r', '\n':
+			keys = append(keys, key{name: "enter"})
+		case 127, 8:
+			keys = append(keys, key{name: "backspace"})
+		case 12:
+			keys = append(keys, key{name: "ctrl-l"})
+		default:
+			if r >= ' ' && r != utf8.RuneError {
+				keys = append(keys, key{r: r})
+			}
+		}
+	}
+	return keys
+}
+
+// key acts on k, false once we are done
+func (ui *tui) key(k key) bool {
+	ui.mu.Lock()
+	defer ui.mu.Unlock()
+	switch k.name {
+	case "":
+		if k.r == 0 {
+			break
+		}
+		ui.input = append(ui.input[:ui.cursor], append([]rune{k.r}, ui.input[ui.cursor:]...)...)
+		ui.cursor++
+	case "enter":
+		line := string(ui.input)
+		ui.input, ui.cursor, ui.scroll = nil, 0, 0
+		if strings.TrimSpace(line) == "" {
+			break
+		}
+		ui.past = append(ui.past, line)
+		ui.pastAt = len(ui.past)
+		select {
+		case ui.typed <- line + "\n":
+		default:
+			ui.lines = append(ui.lines, "still busy with the lines before, try again: "+line)
+		}
+	case "backspace":
+		if ui.cursor > 0 {
+			ui.input = append(ui.input[:ui.cursor-1], ui.input[ui.cursor:]...)
+			ui.cursor--
+		}
+	case "delete":
+		if ui.cursor < len(ui.input) {
+			ui.input = append(ui.input[:ui.cursor], ui.input[ui.cursor+1:]...)
+		}
+	case "left":
+		if ui.cursor > 0 {
+			ui.cursor--
+		}
+	case "right":
+		if ui.cursor < len(ui.input) {
+			ui.cursor++
+		}
+	case "home":
+		ui.cursor = 0
+	case "end":
+		ui.cursor = len(ui.input)
+	case "up", "down":
+		if k.name == "up" && ui.pastAt > 0 {
+			ui.pastAt--
+		} else if k.name == "down" && ui.pastAt < len(ui.past) {
+			ui.pastAt++
+		}
+		ui.input = nil
+		if ui.pastAt < len(ui.past) {
+			ui.input = []rune(ui.past[ui.pastAt])
+		}
+		ui.cursor = len(ui.input)
+	case "pgup":
+		ui.scroll += 10
+	case "pgdn":
+		if ui.scroll -= 10; ui.scroll < 0 {
+			ui.scroll = 0
+		}
+	case "tab":
+		ui.nextRoom()
+	case "ctrl-d":
+		if len(ui.input) > 0 {
+			break
+		}
+		fallthrough
+	case "ctrl-c":
+		ui.cr.quit()
+		return false
+	}
+	return true
+}
+
+// nextRoom makes the next of our rooms the active one
+func (ui *tui) nextRoom() {
+	rooms := ui.cr.rooms.Rooms()
+	active := ui.cr.rooms.Active()
+	if len(rooms) < 2 || active == nil {
+		return
+	}
+	for i, name := range rooms {
+		if name == active.Room() {
+			ui.cr.rooms.SetActive(rooms[(i+1)%len(rooms)])
+			return
+		}
+	}
+}
+
+// draw paints the whole screen
+func (ui *tui) draw() {
+	width, height, err := termSize(int(ui.term.Fd()))
+	if err != nil || width < 20 || height < 5 {
+		return
+	}
+	ui.mu.Lock()
+	defer ui.mu.Unlock()
+	select {
+	case <-ui.stop:
+		return // the terminal is not ours any more
+	default:
+	}
+
+	var b strings.Builder
+	b.WriteString("\x1b[?25l\x1b[H")
+	row := func(n int, s string) {
+		fmt.Fprintf(&b, "\x1b[%d;1H%s\x1b[K", n, s)
+	}
+
+	// room tabs
+	room := ui.cr.rooms.Active()
+	var tabs strings.Builder
+	for _, name := range ui.cr.rooms.Rooms() {
+		if room != nil && name == room.Room() {
+			fmt.Fprintf(&tabs, "\x1b[7m %s \x1b[0m", name)
+		} else {
+			fmt.Fprintf(&tabs, " %s ", name)
+		}
+	}
+	row(1, tabs.String())
+
+	// messages, with the roster beside them if there is room for it
+	paneHeight := height - 3
+	msgWidth, side := width, []string(nil)
+	if width >= 60 {
+		msgWidth = width - sidebarWidth - 1
+		side = ui.roster(room, paneHeight)
+	}
+	var wrapped []string
+	for _, line := range ui.lines {
+		wrapped = append(wrapped, wrap(line, msgWidth)...)
+	}
+	if max := len(wrapped) - paneHeight; ui.scroll > max {
+		ui.scroll = max
+	}
+	if ui.scroll < 0 {
+		ui.scroll = 0
+	}
+	end := len(wrapped) - ui.scroll
+	start := end - paneHeight
+	for i := 0; i < paneHeight; i++ {
+		line := ""
+		if j := start + i; j >= 0 && j < end {
+			line = wrapped[j]
+		}
+		if side != nil {
+			line = pad(line, msgWidth) + "│" + pad(side[i], sidebarWidth)
+		}
+		row(2+i, line)
+	}
+
+	row(height-1, "\x1b[7m"+pad(ui.status(room), width)+"\x1b[0m")
+
+	// the input line, scrolled so that the cursor shows
+	prompt := "> "
+	room0 := 0
+	if over := ui.cursor - (width - len(prompt) - 1); over > 0 {
+		room0 = over
+	}
+	row(height, prompt+string(ui.input[room0:]))
+	fmt.Fprintf(&b, "\x1b[%d;%dH\x1b[?25h", height, len(prompt)+ui.cursor-room0+1)
+	ui.term.WriteString(b.String())
+}
+
+// roster is the sidebar: who is in the room, n lines of it
+func (ui *tui) roster(room *chat.ChatRoom, n int) []string {
+	side := make([]string, n)
+	if room == nil {
+		return side
+	}
+	lines := []string{"in " + room.Room() + ":"}
+	for _, pr := range room.Roster() {
+		line := pr.Nick
+		if pr.Self {
+			line += " (you)"
+		}
+		lines = append(lines, line)
+		if pr.Status != "" {
+			lines = append(lines, "  "+pr.Status)
+		}
+	}
+	copy(side, lines)
+	return side
+}
+
+// status is the status bar: who we are, who we reach, and how
+func (ui *tui) status(room *chat.ChatRoom) string {
+	direct, relayed := 0, 0
+	for _, c := range ui.h.Network().Conns() {
+		if strings.Contains(c.RemoteMultiaddr().String(), "/p2p-circuit") {
+			relayed++
+		} else {
+			direct++
+		}
+	}
+	state := "offline"
+	if direct+relayed > 0 {
+		state = "online"
+	}
+	s := fmt.Sprintf(" %s | %s | %d direct, %d relayed", ui.cr.currentNick(), state, direct, relayed)
+	if room != nil {
+		s += fmt.Sprintf(" | %d in %s", len(room.ListPeers()), room.Room())
+	}
+	if ui.scroll > 0 {
+		s += fmt.Sprintf(" | scrolled up %d", ui.scroll)
+	}
+	return s + " | tab: rooms, pgup/pgdn: scroll"
+}
+
+// wrap cuts line into pieces no wider than width
+func wrap(line string, width int) []string {
+	r := []rune(line)
+	if len(r) <= width {
+		return []string{line}
+	}
+	var lines []string
+	for len(r) > width {
+		lines = append(lines, string(r[:width]))
+		r = r[width:]
+	}
+	return append(lines, string(r))
+}
+
+// pad fits s in width, cutting or filling with spaces
+func pad(s string, width int) string {
+	r := []rune(s)
+	if len(r) >= width {
+		return string(r[:width])
+	}
+	return s + strings.Repeat(" ", width-len(r))
+}
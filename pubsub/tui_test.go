@@ -0,0 +1,52 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseKeys(t *testing.T) {
+	got := parseKeys([]byte("hé\x1b[A\x1b[5~\t\r\x7f\x03"))
+	want := []key{{r: 'h'}, {r: 'é'}, {name: "up"}, {name: "pgup"}, {name: "tab"}, {name: "enter"}, {name: "backspace"}, {name: "ctrl-c"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestWrap(t *testing.T) {
+	if got := wrap("abcdefg", 3); !reflect.DeepEqual(got, []string{"abc", "def", "g"}) {
+		t.Errorf("wrap: %q", got)
+	}
+	if got := wrap("", 3); !reflect.DeepEqual(got, []string{""}) {
+		t.Errorf("wrap empty: %q", got)
+	}
+	if got := pad("abcdef", 4); got != "abcd" {
+		t.Errorf("pad cut: %q", got)
+	}
+	if got := pad("ab", 4); got != "ab  " {
+		t.Errorf("pad fill: %q", got)
+	}
+	if got := ansiRE.ReplaceAllString("\x1b[1;32mhi\x1b[0m", ""); got != "hi" {
+		t.Errorf("ansi: %q", got)
+	}
+}
+
+// enter hands the line on, and never waits for it to be done
+func TestEnterQueues(t *testing.T) {
+	ui := &tui{typed: make(chan string, 1)}
+	for _, line := range []string{"/to bob hi", "hello"} {
+		for _, r := range line {
+			ui.key(key{r: r})
+		}
+		ui.key(key{name: "enter"})
+	}
+	if got := <-ui.typed; got != "/to bob hi\n" {
+		t.Errorf("queued %q", got)
+	}
+	if len(ui.lines) != 1 || ui.lines[0] != "still busy with the lines before, try again: hello" {
+		t.Errorf("pane: %q", ui.lines)
+	}
+	if !reflect.DeepEqual(ui.past, []string{"/to bob hi", "hello"}) || len(ui.input) != 0 {
+		t.Errorf("history %q, input %q", ui.past, string(ui.input))
+	}
+}
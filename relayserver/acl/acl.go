@@ -0,0 +1,241 @@
+// Package acl decides who may use a circuit relay: the peers (or the IP
+// ranges) that may hold a reservation, and the peers circuits may lead to.
+// The list lives in a JSON file, read again on SIGHUP or when it changes:
+//
+//	{
+//	  "peers": ["12D3KooW..."],
+//	  "networks": ["10.0.0.0/8", "2001:db8::/32"],
+//	  "destinations": ["12D3KooW..."]
+//	}
+//
+// A peer may reserve if it is in peers, or reaches us from one of the
+// networks. Circuits may lead to the destinations, or to anyone with a
+// reservation when there are none.
+package acl
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/relay"
+
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+)
+
+// PollInterval is how often Watch looks whether the file has changed
+var PollInterval = 2 * time.Second
+
+type file struct {
+	Peers        []string `json:"peers"`
+	Networks     []string `json:"networks"`
+	Destinations []string `json:"destinations"`
+}
+
+// ACL is the allowlist, hand it to relay.WithACL
+type ACL struct {
+	// Refused, if set before the relay starts, hears of every request
+	// the list turns away: "reserve" or "connect"
+	Refused func(typ string)
+
+	path string
+
+	mu       sync.RWMutex
+	peers    map[peer.ID]bool
+	networks []*net.IPNet
+	dests    map[peer.ID]bool // nil: anyone with a reservation
+	loaded   stamp            // of the file we have
+	failed   stamp            // of the last one that would not read
+}
+
+// stamp tells one version of the file from another
+type stamp struct {
+	modTime time.Time
+	size    int64
+}
+
+func stampOf(info os.FileInfo) stamp {
+	return stamp{info.ModTime(), info.Size()}
+}
+
+var _ relay.ACLFilter = (*ACL)(nil)
+
+// Load reads the allowlist in path
+func Load(path string) (*ACL, error) {
+	a := &ACL{path: path}
+	if err := a.Reload(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Reload reads the file again. If it won't read, the list we had stays,
+// and Watch leaves it be until it changes again.
+func (a *ACL) Reload() error {
+	info, err := os.Stat(a.path)
+	if err != nil {
+		return err
+	}
+	if err := a.reload(stampOf(info)); err != nil {
+		a.mu.Lock()
+		a.failed = stampOf(info)
+		a.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+func (a *ACL) reload(st stamp) error {
+	b, err := os.ReadFile(a.path)
+	if err != nil {
+		return err
+	}
+	var f file
+	if err := json.Unmarshal(b, &f); err != nil {
+		return fmt.Errorf("%s: %v", a.path, err)
+	}
+	peers, err := decodePeers(f.Peers)
+	if err != nil {
+		return fmt.Errorf("%s: peers: %v", a.path, err)
+	}
+	var dests map[peer.ID]bool
+	if len(f.Destinations) > 0 {
+		if dests, err = decodePeers(f.Destinations); err != nil {
+			return fmt.Errorf("%s: destinations: %v", a.path, err)
+		}
+	}
+	var networks []*net.IPNet
+	for _, s := range f.Networks {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return fmt.Errorf("%s: networks: %v", a.path, err)
+		}
+		networks = append(networks, n)
+	}
+
+	a.mu.Lock()
+	a.peers, a.networks, a.dests, a.loaded = peers, networks, dests, st
+	a.mu.Unlock()
+	return nil
+}
+
+func decodePeers(ids []string) (map[peer.ID]bool, error) {
+	peers := make(map[peer.ID]bool)
+	for _, s := range ids {
+		p, err := peer.Decode(s)
+		if err != nil {
+			return nil, fmt.Errorf("%q: %v", s, err)
+		}
+		peers[p] = true
+	}
+	return peers, nil
+}
+
+// Watch reloads the file on SIGHUP, and when it changes, until ctx is done
+func (a *ACL) Watch(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	ticker := time.NewTicker(PollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-hup:
+		case <-ticker.C:
+			if !a.changed() {
+				continue
+			}
+		case <-ctx.Done():
+			return
+		}
+		if err := a.Reload(); err != nil {
+			log.Printf("ACL not reloaded, keeping the old one: %v", err)
+			continue
+		}
+		log.Printf("ACL reloaded: %s", a)
+	}
+}
+
+// changed tells whether the file is new to us: neither the one we have,
+// nor one we already failed to read
+func (a *ACL) changed() bool {
+	info, err := os.Stat(a.path)
+	if err != nil {
+		return false
+	}
+	now := stampOf(info)
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return !now.same(a.loaded) && !now.same(a.failed)
+}
+
+func (s stamp) same(t stamp) bool {
+	return s.modTime.Equal(t.modTime) && s.size == t.size
+}
+
+// AllowReserve lets p reserve if it is on the list, or comes from a
+// network on the list
+func (a *ACL) AllowReserve(p peer.ID, addr ma.Multiaddr) bool {
+	a.mu.RLock()
+	ok := a.peers[p] || a.inNetworks(addr)
+	a.mu.RUnlock()
+	if !ok {
+		log.Printf("ACL: denied reservation to %s from %s", p, addr)
+		a.refused("reserve")
+	}
+	return ok
+}
+
+// AllowConnect lets circuits lead to the destinations on the list
+func (a *ACL) AllowConnect(src peer.ID, srcAddr ma.Multiaddr, dest peer.ID) bool {
+	a.mu.RLock()
+	ok := a.dests == nil || a.dests[dest]
+	a.mu.RUnlock()
+	if !ok {
+		log.Printf("ACL: denied circuit from %s (%s) to %s", src, srcAddr, dest)
+		a.refused("connect")
+	}
+	return ok
+}
+
+func (a *ACL) refused(typ string) {
+	if a.Refused != nil {
+		a.Refused(typ)
+	}
+}
+
+// inNetworks tells whether addr is in one of the networks, a.mu held
+func (a *ACL) inNetworks(addr ma.Multiaddr) bool {
+	if len(a.networks) == 0 || addr == nil {
+		return false
+	}
+	ip, err := manet.ToIP(addr)
+	if err != nil {
+		return false
+	}
+	for _, n := range a.networks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *ACL) String() string {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	dests := "anyone with a reservation"
+	if a.dests != nil {
+		dests = fmt.Sprintf("%d peers", len(a.dests))
+	}
+	return fmt.Sprintf("%d peers and %d networks may reserve, circuits lead to %s", len(a.peers), len(a.networks), dests)
+}
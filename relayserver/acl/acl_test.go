@@ -0,0 +1,82 @@
+package acl
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/test"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+func TestACL(t *testing.T) {
+	alice, bob := test.RandPeerIDFatal(t), test.RandPeerIDFatal(t)
+	path := filepath.Join(t.TempDir(), "acl.json")
+	write := func(s string) {
+		if err := os.WriteFile(path, []byte(s), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(fmt.Sprintf(`{"peers": [%q], "networks": ["10.0.0.0/8"]}`, alice))
+	a, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var refused []string
+	a.Refused = func(typ string) { refused = append(refused, typ) }
+	home := ma.StringCast("/ip4/10.1.2.3/tcp/4001")
+	away := ma.StringCast("/ip4/192.0.2.1/tcp/4001")
+	if !a.AllowReserve(alice, away) || !a.AllowReserve(bob, home) {
+		t.Error("alice, or bob at home, refused")
+	}
+	if a.AllowReserve(bob, away) {
+		t.Error("bob let in from away")
+	}
+	if len(refused) != 1 || refused[0] != "reserve" {
+		t.Errorf("refusals %v", refused)
+	}
+	if !a.AllowConnect(alice, away, bob) {
+		t.Error("no destinations, and still refused")
+	}
+
+	// a file that won't read leaves the list as it was
+	write(`{"peers": ["not a peer"]}`)
+	if err := a.Reload(); err == nil {
+		t.Error("bad file read")
+	}
+	if !a.AllowReserve(alice, away) {
+		t.Error("bad file changed the list")
+	}
+
+	// and is tried once, not on every poll, until it changes again
+	if a.changed() {
+		t.Error("bad file still looks new")
+	}
+	write(`{"peers": ["still not a peer"]}`)
+	if !a.changed() {
+		t.Error("another bad file not noticed")
+	}
+
+	// changes are picked up
+	PollInterval = 10 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go a.Watch(ctx)
+	time.Sleep(20 * time.Millisecond)
+	write(fmt.Sprintf(`{"peers": [%q], "destinations": [%q]}`, bob, alice))
+	os.Chtimes(path, time.Now(), time.Now().Add(time.Second)) // in case the clock is coarse
+	deadline := time.Now().Add(5 * time.Second)
+	for a.AllowReserve(alice, away) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if a.AllowReserve(alice, away) || !a.AllowReserve(bob, away) {
+		t.Error("change not picked up")
+	}
+	if a.AllowConnect(alice, away, bob) || !a.AllowConnect(bob, away, alice) {
+		t.Error("destinations not applied")
+	}
+}
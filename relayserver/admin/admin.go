@@ -0,0 +1,347 @@
+// Package admin lets the operator of a relay look inside it while it runs:
+// who holds a reservation and until when, which circuits are open and how
+// much they carried, who is connected. It also kicks peers out, and bans
+// them. It is a libp2p protocol, open to the peer IDs named as admins: the
+// relay knows who is asking because libp2p does.
+package admin
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/bpc2016/p2p/metrics"
+	"github.com/libp2p/go-libp2p/core/host"
+	bandwidth "github.com/libp2p/go-libp2p/core/metrics"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/proto"
+	"github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/relay"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// Protocol is the admin protocol
+const Protocol = protocol.ID("/p2p-relay/admin/1.0.0")
+
+// streamTimeout bounds a request and its answer
+const streamTimeout = 10 * time.Second
+
+// circuitGrace is how long a circuit the relay let through has to show up
+// as streams before we forget it
+const circuitGrace = 10 * time.Second
+
+// Request is what an admin asks: Op is status, kick, ban or unban
+type Request struct {
+	Op   string  `json:"op"`
+	Peer peer.ID `json:"peer,omitempty"`
+}
+
+// Response answers a Request
+type Response struct {
+	Error  string  `json:"error,omitempty"`
+	Status *Status `json:"status,omitempty"`
+}
+
+// Status is what goes on in the relay
+type Status struct {
+	Relay        peer.ID       `json:"relay"`
+	Up           time.Time     `json:"up"` // since when
+	Reservations []Reservation `json:"reservations"`
+	Circuits     []Circuit     `json:"circuits"`
+	Peers        []Peer        `json:"peers"`
+	Banned       []peer.ID     `json:"banned"`
+}
+
+// Reservation is a peer holding a slot
+type Reservation struct {
+	Peer    peer.ID   `json:"peer"`
+	Expires time.Time `json:"expires"` // zero if we did not see it made
+}
+
+// Circuit is an open relayed connection. The byte counts are those of
+// every circuit source and destination have through the relay, this one
+// and any others they share.
+type Circuit struct {
+	Source      peer.ID   `json:"source"`
+	Destination peer.ID   `json:"destination"`
+	Since       time.Time `json:"since"`
+	FromSource  int64     `json:"from_source"`
+	ToSource    int64     `json:"to_source"`
+}
+
+// Peer is a peer connected to the relay
+type Peer struct {
+	ID       peer.ID  `json:"id"`
+	Addrs    []string `json:"addrs"`
+	BytesIn  int64    `json:"bytes_in"`
+	BytesOut int64    `json:"bytes_out"`
+}
+
+// Traffic is the host's bandwidth reporter, see libp2p.BandwidthReporter,
+// counting what passes through circuits for each peer on top
+type Traffic struct {
+	*bandwidth.BandwidthCounter
+
+	mu      sync.Mutex
+	circuit map[peer.ID]*[2]int64 // in, out on relay streams
+}
+
+// NewTraffic returns a Traffic that has seen nothing yet
+func NewTraffic() *Traffic {
+	return &Traffic{BandwidthCounter: bandwidth.NewBandwidthCounter(), circuit: make(map[peer.ID]*[2]int64)}
+}
+
+func (t *Traffic) LogSentMessageStream(size int64, proto protocol.ID, p peer.ID) {
+	t.BandwidthCounter.LogSentMessageStream(size, proto, p)
+	t.count(proto, p, 1, size)
+}
+
+func (t *Traffic) LogRecvMessageStream(size int64, proto protocol.ID, p peer.ID) {
+	t.BandwidthCounter.LogRecvMessageStream(size, proto, p)
+	t.count(proto, p, 0, size)
+}
+
+func (t *Traffic) count(pid protocol.ID, p peer.ID, dir int, size int64) {
+	if pid != proto.ProtoIDv2Hop && pid != proto.ProtoIDv2Stop {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	c, ok := t.circuit[p]
+	if !ok {
+		c = new([2]int64)
+		t.circuit[p] = c
+	}
+	c[dir] += size
+}
+
+// relayed is what p sent and got through circuits
+func (t *Traffic) relayed(p peer.ID) (in, out int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if c, ok := t.circuit[p]; ok {
+		return c[0], c[1]
+	}
+	return 0, 0
+}
+
+// Server answers admins, and keeps banned peers out. It sees reservations
+// and circuits through the relay's ACL hook: hand it to relay.WithACL, with
+// the ACL the relay would have had (nil for none) as next.
+type Server struct {
+	// Refused, if set before the relay starts, hears of every request
+	// turned away for a ban: "reserve" or "connect"
+	Refused func(typ string)
+
+	h       host.Host
+	traffic *Traffic
+	ttl     time.Duration
+	next    relay.ACLFilter
+	admins  map[peer.ID]bool
+	up      time.Time
+
+	mu       sync.Mutex
+	reserved map[peer.ID]time.Time // when we last let a reservation through
+	circuits []*Circuit
+	banned   map[peer.ID]bool
+}
+
+var _ relay.ACLFilter = (*Server)(nil)
+
+// NewServer serves the admin protocol on h, to admins. traffic is the
+// host's bandwidth reporter, ttl the relay's reservation TTL.
+func NewServer(h host.Host, traffic *Traffic, ttl time.Duration, admins []peer.ID, next relay.ACLFilter) *Server {
+	s := &Server{
+		h:        h,
+		traffic:  traffic,
+		ttl:      ttl,
+		next:     next,
+		admins:   make(map[peer.ID]bool),
+		up:       time.Now(),
+		reserved: make(map[peer.ID]time.Time),
+		banned:   make(map[peer.ID]bool),
+	}
+	for _, p := range admins {
+		s.admins[p] = true
+	}
+	h.SetStreamHandler(Protocol, s.handle)
+	// a banned peer that comes back is shown the door
+	h.Network().Notify(&network.NotifyBundle{ConnectedF: func(_ network.Network, c network.Conn) {
+		if s.isBanned(c.RemotePeer()) {
+			go c.Close()
+		}
+	}})
+	return s
+}
+
+// Close stops serving the admin protocol
+func (s *Server) Close() error {
+	s.h.RemoveStreamHandler(Protocol)
+	return nil
+}
+
+// AllowReserve keeps banned peers out, and notes when reservations are made
+func (s *Server) AllowReserve(p peer.ID, a ma.Multiaddr) bool {
+	if s.isBanned(p) {
+		log.Printf("admin: denied reservation to %s, banned", p)
+		s.refused("reserve")
+		return false
+	}
+	if s.next != nil && !s.next.AllowReserve(p, a) {
+		return false
+	}
+	s.mu.Lock()
+	s.reserved[p] = time.Now()
+	s.mu.Unlock()
+	return true
+}
+
+// AllowConnect keeps banned peers out, and notes the circuit
+func (s *Server) AllowConnect(src peer.ID, srcAddr ma.Multiaddr, dest peer.ID) bool {
+	if s.isBanned(src) || s.isBanned(dest) {
+		log.Printf("admin: denied circuit from %s to %s, banned", src, dest)
+		s.refused("connect")
+		return false
+	}
+	if s.next != nil && !s.next.AllowConnect(src, srcAddr, dest) {
+		return false
+	}
+	s.mu.Lock()
+	s.circuits = append(s.circuits, &Circuit{Source: src, Destination: dest, Since: time.Now()})
+	s.mu.Unlock()
+	return true
+}
+
+func (s *Server) refused(typ string) {
+	if s.Refused != nil {
+		s.Refused(typ)
+	}
+}
+
+func (s *Server) isBanned(p peer.ID) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.banned[p]
+}
+
+// handle answers a request from an admin
+func (s *Server) handle(st network.Stream) {
+	defer st.Close()
+	st.SetDeadline(time.Now().Add(streamTimeout))
+	from := st.Conn().RemotePeer()
+	if !s.admins[from] {
+		log.Printf("admin: refused %s, not an admin", from)
+		json.NewEncoder(st).Encode(&Response{Error: "not an admin"})
+		return
+	}
+	var req Request
+	if err := json.NewDecoder(bufio.NewReader(st)).Decode(&req); err != nil {
+		st.Reset()
+		return
+	}
+	resp := s.Do(&req)
+	if resp.Error == "" && req.Op != "status" {
+		log.Printf("admin: %s %s, asked by %s", req.Op, req.Peer, from)
+	}
+	json.NewEncoder(st).Encode(resp)
+}
+
+// Do carries out req
+func (s *Server) Do(req *Request) *Response {
+	switch req.Op {
+	case "status":
+		return &Response{Status: s.Status()}
+	case "kick", "ban", "unban":
+		if req.Peer == "" {
+			return &Response{Error: req.Op + " whom?"}
+		}
+	default:
+		return &Response{Error: fmt.Sprintf("no op %q", req.Op)}
+	}
+	s.mu.Lock()
+	switch req.Op {
+	case "ban":
+		s.banned[req.Peer] = true
+	case "unban":
+		delete(s.banned, req.Peer)
+	}
+	s.mu.Unlock()
+	if req.Op != "unban" {
+		// the relay drops the reservation, and the circuits, with the connections
+		if err := s.h.Network().ClosePeer(req.Peer); err != nil {
+			return &Response{Error: err.Error()}
+		}
+	}
+	return &Response{}
+}
+
+// Status is what goes on in the relay now
+func (s *Server) Status() *Status {
+	now := time.Now()
+	st := &Status{Relay: s.h.ID(), Up: s.up, Reservations: []Reservation{}, Circuits: []Circuit{}, Peers: []Peer{}, Banned: []peer.ID{}}
+
+	// open relay streams, by peer: hop from the source, stop to the destination
+	hops, stops := make(map[peer.ID]int), make(map[peer.ID]int)
+	for _, c := range s.h.Network().Conns() {
+		for _, str := range c.GetStreams() {
+			switch str.Protocol() {
+			case proto.ProtoIDv2Hop:
+				hops[c.RemotePeer()]++
+			case proto.ProtoIDv2Stop:
+				stops[c.RemotePeer()]++
+			}
+		}
+	}
+
+	s.mu.Lock()
+	for _, p := range s.h.Network().Peers() {
+		if !metrics.Reserved(s.h, p) {
+			delete(s.reserved, p)
+			continue
+		}
+		r := Reservation{Peer: p}
+		if at, ok := s.reserved[p]; ok {
+			r.Expires = at.Add(s.ttl)
+		}
+		st.Reservations = append(st.Reservations, r)
+	}
+	live := s.circuits[:0]
+	for _, c := range s.circuits {
+		open := hops[c.Source] > 0 && stops[c.Destination] > 0
+		if !open && now.Sub(c.Since) > circuitGrace {
+			continue // closed, or never opened
+		}
+		live = append(live, c)
+		if open {
+			hops[c.Source]--
+			stops[c.Destination]--
+			circuit := *c
+			circuit.FromSource, circuit.ToSource = s.traffic.relayed(c.Source)
+			st.Circuits = append(st.Circuits, circuit)
+		}
+	}
+	s.circuits = live
+	for p := range s.banned {
+		st.Banned = append(st.Banned, p)
+	}
+	s.mu.Unlock()
+
+	for _, p := range s.h.Network().Peers() {
+		bw := s.traffic.GetBandwidthForPeer(p)
+		pr := Peer{ID: p, BytesIn: bw.TotalIn, BytesOut: bw.TotalOut}
+		for _, c := range s.h.Network().ConnsToPeer(p) {
+			pr.Addrs = append(pr.Addrs, c.RemoteMultiaddr().String())
+		}
+		st.Peers = append(st.Peers, pr)
+	}
+	sort.Slice(st.Reservations, func(i, j int) bool { return st.Reservations[i].Peer < st.Reservations[j].Peer })
+	sort.Slice(st.Peers, func(i, j int) bool { return st.Peers[i].ID < st.Peers[j].ID })
+	sort.Slice(st.Banned, func(i, j int) bool { return st.Banned[i] < st.Banned[j] })
+	return st
+}
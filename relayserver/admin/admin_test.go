@@ -0,0 +1,113 @@
+package admin
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/client"
+	"github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/relay"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+func newHost(t *testing.T, opts ...libp2p.Option) host.Host {
+	h, err := libp2p.New(append([]libp2p.Option{libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0")}, opts...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { h.Close() })
+	return h
+}
+
+func TestAdmin(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	traffic := NewTraffic()
+	rh := newHost(t, libp2p.BandwidthReporter(traffic))
+	op, dest, src := newHost(t), newHost(t), newHost(t)
+	srv := NewServer(rh, traffic, time.Hour, []peer.ID{op.ID()}, nil)
+	rly, err := relay.New(rh, relay.WithACL(srv), relay.WithInfiniteLimits())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rly.Close()
+	ri := peer.AddrInfo{ID: rh.ID(), Addrs: rh.Addrs()}
+
+	// dest reserves, src reaches it through the relay
+	if err := dest.Connect(ctx, ri); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Reserve(ctx, dest, ri); err != nil {
+		t.Fatal(err)
+	}
+	dest.SetStreamHandler("/echo", func(s network.Stream) {
+		io.Copy(s, s)
+		s.Close()
+	})
+	circuit := ma.StringCast("/p2p/" + rh.ID().String() + "/p2p-circuit/p2p/" + dest.ID().String())
+	if err := src.Connect(ctx, ri); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.Connect(ctx, peer.AddrInfo{ID: dest.ID(), Addrs: []ma.Multiaddr{circuit}}); err != nil {
+		t.Fatal(err)
+	}
+	s, err := src.NewStream(network.WithUseTransient(ctx, "test"), dest.ID(), "/echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Write([]byte("hello"))
+	io.ReadFull(s, make([]byte, 5))
+
+	// an admin sees it all
+	resp, err := Ask(ctx, op, ri, &Request{Op: "status"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := resp.Status
+	if len(st.Reservations) != 1 || st.Reservations[0].Peer != dest.ID() || st.Reservations[0].Expires.Before(time.Now()) {
+		t.Errorf("reservations: %+v", st.Reservations)
+	}
+	if len(st.Circuits) != 1 || st.Circuits[0].Source != src.ID() || st.Circuits[0].Destination != dest.ID() || st.Circuits[0].FromSource == 0 {
+		t.Errorf("circuits: %+v", st.Circuits)
+	}
+	if len(st.Peers) != 3 {
+		t.Errorf("peers: %+v", st.Peers)
+	}
+	s.Close()
+
+	// nobody else does
+	if _, err := Ask(ctx, src, ri, &Request{Op: "status"}); err == nil {
+		t.Error("status for someone who is not an admin")
+	}
+
+	// a banned source gets no more circuits
+	if _, err := Ask(ctx, op, ri, &Request{Op: "ban", Peer: src.ID()}); err != nil {
+		t.Fatal(err)
+	}
+	refused := 0
+	srv.Refused = func(typ string) { refused++ }
+	if srv.AllowConnect(src.ID(), nil, dest.ID()) || refused != 1 {
+		t.Errorf("banned, and still let through, %d refusals", refused)
+	}
+	if _, err := Ask(ctx, op, ri, &Request{Op: "unban", Peer: src.ID()}); err != nil {
+		t.Fatal(err)
+	}
+	if !srv.AllowConnect(src.ID(), nil, dest.ID()) {
+		t.Error("unbanned, and still kept out")
+	}
+
+	// a kicked destination loses its reservation
+	if _, err := Ask(ctx, op, ri, &Request{Op: "kick", Peer: dest.ID()}); err != nil {
+		t.Fatal(err)
+	}
+	if got := srv.Status().Reservations; len(got) != 0 {
+		t.Errorf("kicked, still reserved: %+v", got)
+	}
+}
@@ -0,0 +1,152 @@
+package admin
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/bpc2016/p2p/identity"
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// Usage is how the admin subcommands are used
+const Usage = `usage: %s <status|kick|ban|unban> -relay <multiaddr> [-key file] [peer]
+
+  status  show reservations, circuits and connected peers (-json for JSON)
+  kick    close the connections of peer, dropping its reservation and circuits
+  ban     kick peer, and keep it out until unban (or a restart)
+  unban   let peer back in
+
+The key file is the identity of an admin, see the identity subcommand and
+the relay's -admins flag.
+`
+
+// Commands are the admin subcommands, for main to spot
+var Commands = map[string]bool{"status": true, "kick": true, "ban": true, "unban": true}
+
+// Command runs the admin subcommand args[0] of program against a relay,
+// writing to out
+func Command(program string, args []string, out io.Writer) error {
+	if len(args) == 0 || !Commands[args[0]] {
+		return fmt.Errorf(Usage, program)
+	}
+	fs := flag.NewFlagSet(program+" "+args[0], flag.ContinueOnError)
+	fs.SetOutput(out)
+	relayF := fs.String("relay", "", "multiaddr of the relay, with its /p2p/ part")
+	keyF := fs.String("key", "admin.key", "key file of an admin")
+	jsonF := fs.Bool("json", false, "print the status as JSON")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	req := &Request{Op: args[0]}
+	if req.Op != "status" {
+		if fs.NArg() != 1 {
+			return fmt.Errorf("%s which peer?", req.Op)
+		}
+		p, err := peer.Decode(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		req.Peer = p
+	}
+	if *relayF == "" {
+		return errors.New("which relay? give -relay")
+	}
+	ri, err := peer.AddrInfoFromString(*relayF)
+	if err != nil {
+		return err
+	}
+	key, err := identity.Load(*keyF, identity.Passphrase())
+	if err != nil {
+		return err
+	}
+	h, err := libp2p.New(libp2p.Identity(key), libp2p.NoListenAddrs)
+	if err != nil {
+		return err
+	}
+	defer h.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), streamTimeout)
+	defer cancel()
+	resp, err := Ask(ctx, h, *ri, req)
+	if err != nil {
+		return err
+	}
+	if resp.Status == nil {
+		_, err = fmt.Fprintf(out, "%s %s: done\n", req.Op, req.Peer)
+		return err
+	}
+	if *jsonF {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(resp.Status)
+	}
+	return PrintStatus(out, resp.Status)
+}
+
+// Ask sends req to the relay's admin protocol, from h
+func Ask(ctx context.Context, h host.Host, relay peer.AddrInfo, req *Request) (*Response, error) {
+	if err := h.Connect(ctx, relay); err != nil {
+		return nil, err
+	}
+	s, err := h.NewStream(ctx, relay.ID, Protocol)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		s.SetDeadline(deadline)
+	}
+	if err := json.NewEncoder(s).Encode(req); err != nil {
+		s.Reset()
+		return nil, err
+	}
+	var resp Response
+	if err := json.NewDecoder(bufio.NewReader(s)).Decode(&resp); err != nil {
+		return nil, err
+	}
+	if resp.Error != "" {
+		return nil, fmt.Errorf("relay says: %s", resp.Error)
+	}
+	return &resp, nil
+}
+
+// PrintStatus writes st out for people
+func PrintStatus(out io.Writer, st *Status) error {
+	var b strings.Builder
+	now := time.Now()
+	fmt.Fprintf(&b, "relay %s, up %v\n", st.Relay, now.Sub(st.Up).Round(time.Second))
+	fmt.Fprintf(&b, "reservations (%d):\n", len(st.Reservations))
+	for _, r := range st.Reservations {
+		expires := "unknown"
+		if !r.Expires.IsZero() {
+			expires = r.Expires.Sub(now).Round(time.Second).String()
+		}
+		fmt.Fprintf(&b, "  %s  expires in %s\n", r.Peer, expires)
+	}
+	fmt.Fprintf(&b, "circuits (%d):\n", len(st.Circuits))
+	for _, c := range st.Circuits {
+		fmt.Fprintf(&b, "  %s -> %s  for %v, %d bytes from the source, %d back\n",
+			c.Source, c.Destination, now.Sub(c.Since).Round(time.Second), c.FromSource, c.ToSource)
+	}
+	fmt.Fprintf(&b, "peers (%d):\n", len(st.Peers))
+	for _, p := range st.Peers {
+		fmt.Fprintf(&b, "  %s  %s  %d bytes in, %d out\n", p.ID, strings.Join(p.Addrs, " "), p.BytesIn, p.BytesOut)
+	}
+	if len(st.Banned) > 0 {
+		fmt.Fprintf(&b, "banned (%d):\n", len(st.Banned))
+		for _, p := range st.Banned {
+			fmt.Fprintf(&b, "  %s\n", p)
+		}
+	}
+	_, err := io.WriteString(out, b.String())
+	return err
+}
@@ -3,56 +3,86 @@ package main
 import (
 	"context"
 	"crypto/rand"
-	"fmt"
+	"flag"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"github.com/bpc2016/p2p/identity"
+	"github.com/bpc2016/p2p/relayserver/limits"
+	"github.com/bpc2016/p2p/relayserver/listen"
 	"github.com/libp2p/go-libp2p"
 	"github.com/libp2p/go-libp2p/core/crypto"
-	"github.com/libp2p/go-libp2p/core/host"
 	"github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/relay"
-
-	ma "github.com/multiformats/go-multiaddr"
 )
 
-func getHostAddress(ha host.Host) string {
-	// Build host multiaddress
-	hostAddr, _ := ma.NewMultiaddr(fmt.Sprintf("/p2p/%s", ha.ID().String()))
-
-	// Now we can build a full multiaddress to reach this host
-	// by encapsulating both addresses:
-	addr := ha.Addrs()[0]
-	return addr.Encapsulate(hostAddr).String()
-}
-
 func main() {
-	ctx, cancel := context.WithCancel(context.Background())
+	if len(os.Args) > 1 && os.Args[1] == "identity" {
+		if err := identity.Command(os.Args[0], os.Args[2:], os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// ^C or SIGTERM stop the relay
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer cancel()
-	// var r io.Reader
-	// if randseed == 0 {
-	var r = rand.Reader
-	// } else {
-	// 	r = mrand.New(mrand.NewSource(randseed))
-	// }
+	keyF := flag.String("key", "", "file keeping the relay's identity, created if missing; empty for a new one each run")
+	limitsF := limits.AddFlags(flag.CommandLine, "public")
+	portF := flag.Int("l", 8919, "port to wait for connections on, TCP and QUIC, unless -listen says otherwise")
+	listenF := listen.AddFlags(flag.CommandLine, portF)
+	flag.Parse()
+	rc, err := limitsF.Resources()
+	if err != nil {
+		log.Fatal(err)
+	}
+	lc, err := listenF.Config()
+	if err != nil {
+		log.Fatal(err)
+	}
+	listenOpts, err := lc.Options()
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	// Generate a key pair for this host. We will use it at least
-	// to obtain a valid host ID.
-	priv, _, err := crypto.GenerateKeyPairWithReader(crypto.RSA, 2048, r)
+	// Generate a key pair for this host, unless we keep one. We will use it
+	// at least to obtain a valid host ID.
+	var priv crypto.PrivKey
+	if *keyF != "" {
+		priv, _, err = identity.LoadOrCreate(*keyF, identity.Passphrase())
+	} else {
+		priv, _, err = crypto.GenerateKeyPairWithReader(crypto.RSA, 2048, rand.Reader)
+	}
 	if err != nil {
 		log.Printf("Failed to generate key pair: %v", err)
 		return
 	}
 
 	// Create a host to act as a middleman to relay messages on our behalf
-	relay1, err := libp2p.New(
-		libp2p.ListenAddrStrings(fmt.Sprintf("/ip4/0.0.0.0/tcp/%d", 8919)),
-		libp2p.Identity(priv),
-	)
+	relay1, err := libp2p.New(append(listenOpts, libp2p.Identity(priv))...)
 	if err != nil {
 		log.Printf("Failed to create relay1: %v", err)
 		return
 	}
 
-	fullAddr := getHostAddress(relay1)
+	// every address clients can reach us at, as we tell them
+	full := listen.Full(relay1)
+	for _, addr := range full {
+		log.Printf("Reachable at %s", addr)
+	}
+	if len(full) == 0 {
+		log.Printf("No address to give clients, see -announce and -no-announce")
+		full = append(full, "/p2p/"+relay1.ID().String())
+	}
+	if *listenF.AddrsFile != "" {
+		if err := listen.WriteAddrs(ctx, relay1, *listenF.AddrsFile); err != nil {
+			log.Printf("Failed to write the addresses: %v", err)
+			return
+		}
+		log.Printf("Addresses written to %s", *listenF.AddrsFile)
+	}
 
 	// Configure the host to offer the ciruit relay service.
 	// Any host that is directly dialable in the network (or on the internet)
@@ -60,14 +90,28 @@ func main() {
 	// "dedicated" relay services.
 	// In circuit relay v2 (which we're using here!) it is rate limited so that
 	// any node can offer this service safely
-	_, err = relay.New(relay1)
+	log.Printf("Relay limits: %s", limits.String(rc))
+	rly, err := relay.New(relay1, relay.WithResources(rc))
 	if err != nil {
 		log.Printf("Failed to instantiate the relay: %v", err)
 		return
 	}
 
-	log.Printf("Relay is: %s\nUse this address in setting up relay services", fullAddr)
+	log.Printf("Relay is: %s\nUse this address, or any above, in setting up relay services", full[0])
 
 	// Run until canceled.
 	<-ctx.Done()
+	cancel() // a second ^C kills us
+	log.Println("Relay closing")
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		rly.Close()
+		relay1.Close()
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		log.Println("gave up waiting for the host to close")
+	}
 }
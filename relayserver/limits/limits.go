@@ -0,0 +1,289 @@
+// Package limits sets the resources a circuit relay may use: how many
+// reservations it holds, from whom, for how long, and how long and how much
+// each circuit may carry. Start from a preset, then change what you need in
+// a limits file or with flags, in that order.
+package limits
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/relay"
+)
+
+// Presets for the common cases:
+//
+//	public   the libp2p defaults, for a relay anyone may use: circuits last
+//	         2 minutes and carry 128KB each way, enough to hole punch
+//	private  for a relay your own peers use: circuits of an hour and 1GB
+//	demo     circuits are not limited at all, as the relay always had it
+//
+// Mind that libp2p marks a circuit with limits transient: peers have to
+// opt in, with network.WithUseTransient, to open streams on it, and
+// gossipsub does not. Only demo circuits carry pubsub chat.
+var presets = map[string]func() relay.Resources{
+	"public": relay.DefaultResources,
+	"private": func() relay.Resources {
+		rc := relay.DefaultResources()
+		rc.Limit = &relay.RelayLimit{Duration: time.Hour, Data: 1 << 30}
+		rc.MaxReservations = 1024
+		rc.MaxCircuits = 64
+		rc.BufferSize = 16 << 10
+		rc.MaxReservationsPerPeer = 8
+		rc.MaxReservationsPerIP = 64
+		rc.MaxReservationsPerASN = 256
+		return rc
+	},
+	"demo": func() relay.Resources {
+		rc := relay.DefaultResources()
+		rc.Limit = nil
+		return rc
+	},
+}
+
+// Default is the preset of the relay, see relayserver
+const Default = "demo"
+
+// Presets lists the names of the presets
+func Presets() []string {
+	var names []string
+	for name := range presets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Preset returns the resources of the preset called name
+func Preset(name string) (relay.Resources, error) {
+	preset, ok := presets[name]
+	if !ok {
+		return relay.Resources{}, fmt.Errorf("no preset %q, try one of %s", name, strings.Join(Presets(), ", "))
+	}
+	return preset(), nil
+}
+
+// Duration is a time.Duration that reads and writes as "90s", "1h" and the like
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	*d = Duration(v)
+	return err
+}
+
+// File is a limits file: the preset to start from, and whatever should be
+// different. Anything left out keeps its preset value.
+//
+//	{"preset": "public", "reservation_ttl": "30m", "circuit_data": 1048576}
+type File struct {
+	Preset                 string    `json:"preset,omitempty"`
+	ReservationTTL         *Duration `json:"reservation_ttl,omitempty"`
+	MaxReservations        *int      `json:"max_reservations,omitempty"`
+	MaxReservationsPerPeer *int      `json:"max_reservations_per_peer,omitempty"`
+	MaxReservationsPerIP   *int      `json:"max_reservations_per_ip,omitempty"`
+	MaxReservationsPerASN  *int      `json:"max_reservations_per_asn,omitempty"`
+	MaxCircuits            *int      `json:"max_circuits,omitempty"` // for each peer
+	BufferSize             *int      `json:"buffer_size,omitempty"`
+	CircuitDuration        *Duration `json:"circuit_duration,omitempty"`
+	CircuitData            *int64    `json:"circuit_data,omitempty"` // bytes, each way
+	Unlimited              *bool     `json:"unlimited,omitempty"`    // no circuit limits
+}
+
+// Load reads a limits file
+func Load(path string) (*File, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var f File
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&f); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return &f, nil
+}
+
+// Apply changes rc as f says, but for the preset
+func (f *File) Apply(rc *relay.Resources) {
+	if f.ReservationTTL != nil {
+		rc.ReservationTTL = time.Duration(*f.ReservationTTL)
+	}
+	setInt(&rc.MaxReservations, f.MaxReservations)
+	setInt(&rc.MaxReservationsPerPeer, f.MaxReservationsPerPeer)
+	setInt(&rc.MaxReservationsPerIP, f.MaxReservationsPerIP)
+	setInt(&rc.MaxReservationsPerASN, f.MaxReservationsPerASN)
+	setInt(&rc.MaxCircuits, f.MaxCircuits)
+	setInt(&rc.BufferSize, f.BufferSize)
+	if f.CircuitDuration != nil || f.CircuitData != nil {
+		limit := relay.DefaultLimit()
+		if rc.Limit != nil {
+			*limit = *rc.Limit
+		}
+		if f.CircuitDuration != nil {
+			limit.Duration = time.Duration(*f.CircuitDuration)
+		}
+		if f.CircuitData != nil {
+			limit.Data = *f.CircuitData
+		}
+		rc.Limit = limit
+	}
+	if f.Unlimited != nil && *f.Unlimited {
+		rc.Limit = nil
+	}
+}
+
+func setInt(to *int, from *int) {
+	if from != nil {
+		*to = *from
+	}
+}
+
+// Check makes sure the relay can work with rc
+func Check(rc relay.Resources) error {
+	var bad []string
+	if rc.ReservationTTL <= 0 {
+		bad = append(bad, "reservation TTL")
+	}
+	for name, n := range map[string]int{
+		"max reservations":          rc.MaxReservations,
+		"max reservations per peer": rc.MaxReservationsPerPeer,
+		"max reservations per IP":   rc.MaxReservationsPerIP,
+		"max reservations per ASN":  rc.MaxReservationsPerASN,
+		"max circuits":              rc.MaxCircuits,
+		"buffer size":               rc.BufferSize,
+	} {
+		if n <= 0 {
+			bad = append(bad, name)
+		}
+	}
+	if rc.Limit != nil && (rc.Limit.Duration <= 0 || rc.Limit.Data <= 0) {
+		bad = append(bad, "circuit duration and data (or unlimited)")
+	}
+	if len(bad) == 0 {
+		return nil
+	}
+	sort.Strings(bad)
+	return errors.New("limits: these must be positive: " + strings.Join(bad, ", "))
+}
+
+// String describes rc in a line, for the log
+func String(rc relay.Resources) string {
+	circuits := "unlimited"
+	if rc.Limit != nil {
+		circuits = fmt.Sprintf("%v and %d bytes each way", rc.Limit.Duration, rc.Limit.Data)
+	}
+	return fmt.Sprintf("reservations: %d for %v, %d per peer, %d per IP, %d per ASN; circuits: %d per peer, %s, buffers of %d bytes",
+		rc.MaxReservations, rc.ReservationTTL, rc.MaxReservationsPerPeer, rc.MaxReservationsPerIP, rc.MaxReservationsPerASN,
+		rc.MaxCircuits, circuits, rc.BufferSize)
+}
+
+// Flags are the command line flags for the limits
+type Flags struct {
+	fs     *flag.FlagSet
+	preset *string
+	file   *string
+	f      File // where the flags go, applied only if given
+	ttl    time.Duration
+	dur    time.Duration
+}
+
+// AddFlags adds the limits flags to fs, with preset as the default
+func AddFlags(fs *flag.FlagSet, preset string) *Flags {
+	fl := &Flags{fs: fs, f: File{
+		MaxReservations: new(int), MaxReservationsPerPeer: new(int), MaxReservationsPerIP: new(int),
+		MaxReservationsPerASN: new(int), MaxCircuits: new(int), BufferSize: new(int),
+		CircuitData: new(int64), Unlimited: new(bool),
+	}}
+	fl.preset = fs.String("limits", preset, "relay limits to start from: "+strings.Join(Presets(), ", "))
+	fl.file = fs.String("limits-file", "", "JSON file changing the -limits preset, see package limits")
+	fs.DurationVar(&fl.ttl, "reservation-ttl", 0, "how long a reservation lasts")
+	fs.IntVar(fl.f.MaxReservations, "max-reservations", 0, "reservations held in all")
+	fs.IntVar(fl.f.MaxReservationsPerPeer, "max-reservations-per-peer", 0, "reservations from any one peer")
+	fs.IntVar(fl.f.MaxReservationsPerIP, "max-reservations-per-ip", 0, "reservations from any one IP address")
+	fs.IntVar(fl.f.MaxReservationsPerASN, "max-reservations-per-asn", 0, "reservations from any one network (ASN)")
+	fs.IntVar(fl.f.MaxCircuits, "max-circuits", 0, "circuits open for any one peer")
+	fs.IntVar(fl.f.BufferSize, "buffer-size", 0, "bytes buffered for each circuit")
+	fs.DurationVar(&fl.dur, "circuit-duration", 0, "how long a circuit lasts")
+	fs.Int64Var(fl.f.CircuitData, "circuit-data", 0, "bytes a circuit carries each way")
+	fs.BoolVar(fl.f.Unlimited, "unlimited", false, "circuits last and carry as much as they like")
+	return fl
+}
+
+// Resources puts together preset, file and flags, once the flags are parsed
+func (fl *Flags) Resources() (relay.Resources, error) {
+	var f File
+	if *fl.file != "" {
+		loaded, err := Load(*fl.file)
+		if err != nil {
+			return relay.Resources{}, err
+		}
+		f = *loaded
+	}
+	preset := *fl.preset
+	if f.Preset != "" && !fl.given("limits") {
+		preset = f.Preset
+	}
+	rc, err := Preset(preset)
+	if err != nil {
+		return rc, err
+	}
+	f.Apply(&rc)
+
+	// flags given have the last word
+	var given File
+	fl.fs.Visit(func(fg *flag.Flag) {
+		switch fg.Name {
+		case "reservation-ttl":
+			ttl := Duration(fl.ttl)
+			given.ReservationTTL = &ttl
+		case "max-reservations":
+			given.MaxReservations = fl.f.MaxReservations
+		case "max-reservations-per-peer":
+			given.MaxReservationsPerPeer = fl.f.MaxReservationsPerPeer
+		case "max-reservations-per-ip":
+			given.MaxReservationsPerIP = fl.f.MaxReservationsPerIP
+		case "max-reservations-per-asn":
+			given.MaxReservationsPerASN = fl.f.MaxReservationsPerASN
+		case "max-circuits":
+			given.MaxCircuits = fl.f.MaxCircuits
+		case "buffer-size":
+			given.BufferSize = fl.f.BufferSize
+		case "circuit-duration":
+			dur := Duration(fl.dur)
+			given.CircuitDuration = &dur
+		case "circuit-data":
+			given.CircuitData = fl.f.CircuitData
+		case "unlimited":
+			given.Unlimited = fl.f.Unlimited
+		}
+	})
+	given.Apply(&rc)
+	return rc, Check(rc)
+}
+
+func (fl *Flags) given(name string) bool {
+	found := false
+	fl.fs.Visit(func(fg *flag.Flag) {
+		if fg.Name == name {
+			found = true
+		}
+	})
+	return found
+}
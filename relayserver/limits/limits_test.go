@@ -0,0 +1,148 @@
+package limits
+
+import (
+	"context"
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/client"
+	"github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/relay"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+func TestPresets(t *testing.T) {
+	for _, name := range Presets() {
+		rc, err := Preset(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := Check(rc); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+	if rc, _ := Preset("demo"); rc.Limit != nil {
+		t.Error("demo limits circuits")
+	}
+	if _, err := Preset("nope"); err == nil {
+		t.Error("no error for a preset that is not there")
+	}
+}
+
+func TestResources(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "limits.json")
+	file := `{"preset": "demo", "reservation_ttl": "30m", "max_reservations": 10, "circuit_data": 4096}`
+	if err := os.WriteFile(path, []byte(file), 0600); err != nil {
+		t.Fatal(err)
+	}
+	fs := flag.NewFlagSet("relay", flag.ContinueOnError)
+	fl := AddFlags(fs, "public")
+	if err := fs.Parse([]string{"-limits-file", path, "-max-reservations", "20", "-circuit-duration", "1m"}); err != nil {
+		t.Fatal(err)
+	}
+	rc, err := fl.Resources()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// demo from the file, then the file, then the flags
+	if rc.ReservationTTL != 30*time.Minute || rc.MaxReservations != 20 || rc.MaxCircuits != 16 {
+		t.Errorf("got %s", String(rc))
+	}
+	if rc.Limit == nil || rc.Limit.Duration != time.Minute || rc.Limit.Data != 4096 {
+		t.Errorf("circuits: got %s", String(rc))
+	}
+
+	fs = flag.NewFlagSet("relay", flag.ContinueOnError)
+	fl = AddFlags(fs, "public")
+	fs.Parse([]string{"-max-circuits", "0"})
+	if _, err := fl.Resources(); err == nil {
+		t.Error("no circuits at all, and no error")
+	}
+}
+
+// relayed has src reach dest through a relay with the limits of preset
+func relayed(t *testing.T, preset string) (ctx context.Context, src host.Host, dest peer.ID) {
+	rc, err := Preset(preset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	t.Cleanup(cancel)
+	// go-libp2p v0.26 loses the transient mark of a circuit in the swarm's
+	// metrics wrapper; without metrics the hosts see circuits as they should
+	newHost := func(opts ...libp2p.Option) host.Host {
+		h, err := libp2p.New(append([]libp2p.Option{libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"), libp2p.DisableMetrics()}, opts...)...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { h.Close() })
+		return h
+	}
+	// dest can only be reached through the relay, as in chatclients
+	rh, d, src := newHost(), newHost(libp2p.NoListenAddrs, libp2p.EnableRelay()), newHost()
+	rly, err := relay.New(rh, relay.WithResources(rc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { rly.Close() })
+
+	ri := peer.AddrInfo{ID: rh.ID(), Addrs: rh.Addrs()}
+	if err := d.Connect(ctx, ri); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Reserve(ctx, d, ri); err != nil {
+		t.Fatal(err)
+	}
+	d.SetStreamHandler("/echo", func(s network.Stream) {
+		io.Copy(s, s)
+		s.Close()
+	})
+	circuit := ma.StringCast("/p2p/" + rh.ID().String() + "/p2p-circuit/p2p/" + d.ID().String())
+	if err := src.Connect(ctx, ri); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.Connect(ctx, peer.AddrInfo{ID: d.ID(), Addrs: []ma.Multiaddr{circuit}}); err != nil {
+		t.Fatal(err)
+	}
+	return ctx, src, d.ID()
+}
+
+func echo(ctx context.Context, src host.Host, dest peer.ID) error {
+	s, err := src.NewStream(ctx, dest, "/echo")
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	if _, err := s.Write([]byte("hello")); err != nil {
+		return err
+	}
+	_, err = io.ReadFull(s, make([]byte, 5))
+	return err
+}
+
+// the relay's default has to carry streams of peers that do not opt in to
+// transient connections, gossipsub for one
+func TestDefaultCircuits(t *testing.T) {
+	ctx, src, dest := relayed(t, Default)
+	if err := echo(ctx, src, dest); err != nil {
+		t.Fatalf("relayed stream with the %s preset: %v", Default, err)
+	}
+}
+
+func TestLimitedCircuits(t *testing.T) {
+	ctx, src, dest := relayed(t, "private")
+	if err := echo(ctx, src, dest); err == nil {
+		t.Error("limited circuit, and a stream without opting in")
+	}
+	if err := echo(network.WithUseTransient(ctx, "test"), src, dest); err != nil {
+		t.Error(err)
+	}
+}
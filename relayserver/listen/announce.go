@@ -0,0 +1,146 @@
+package listen
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/libp2p/go-libp2p/core/event"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+)
+
+// Behind port forwarding, the addresses a relay listens on are private ones,
+// of no use to clients. -announce gives the addresses to tell them instead,
+// and -no-announce those never to tell: a multiaddr, a network such as
+// 10.0.0.0/8, or "private" for every private and loopback address.
+
+// factory rewrites the addresses the host tells of, as c says
+func (c Config) factory() (func([]ma.Multiaddr) []ma.Multiaddr, error) {
+	var announce []ma.Multiaddr
+	for _, s := range c.Announce {
+		a, err := ma.NewMultiaddr(s)
+		if err != nil {
+			return nil, fmt.Errorf("announce: %q: %v", s, err)
+		}
+		announce = append(announce, a)
+	}
+	var drop []func(ma.Multiaddr) bool
+	for _, s := range c.NoAnnounce {
+		s := s
+		switch _, network, err := net.ParseCIDR(s); {
+		case s == "private":
+			drop = append(drop, manet.IsPrivateAddr)
+		case err == nil:
+			drop = append(drop, func(a ma.Multiaddr) bool {
+				ip, err := manet.ToIP(a)
+				return err == nil && network.Contains(ip)
+			})
+		default:
+			a, err := ma.NewMultiaddr(s)
+			if err != nil {
+				return nil, fmt.Errorf("no-announce: %q is neither a multiaddr, a network nor private", s)
+			}
+			drop = append(drop, a.Equal)
+		}
+	}
+	if announce == nil && drop == nil {
+		return nil, nil
+	}
+	return func(addrs []ma.Multiaddr) []ma.Multiaddr {
+		if announce != nil {
+			addrs = announce
+		}
+		var told []ma.Multiaddr
+	next:
+		for _, a := range addrs {
+			for _, d := range drop {
+				if d(a) {
+					continue next
+				}
+			}
+			told = append(told, a)
+		}
+		return told
+	}, nil
+}
+
+// Full are the addresses of h, with its /p2p/ part: what to give clients
+func Full(h host.Host) []string {
+	full := []string{}
+	for _, a := range h.Addrs() {
+		full = append(full, fmt.Sprintf("%s/p2p/%s", a, h.ID()))
+	}
+	return full
+}
+
+// Addrs is what WriteAddrs writes. It reads as a peer.AddrInfo too.
+type Addrs struct {
+	ID    peer.ID  `json:"id"`
+	Addrs []string `json:"addrs"` // without the /p2p/ part
+	Full  []string `json:"full"`  // with it
+}
+
+// WriteAddrs writes the addresses of h to path, as JSON, now and whenever
+// they change until ctx is done
+func WriteAddrs(ctx context.Context, h host.Host, path string) error {
+	sub, err := h.EventBus().Subscribe(new(event.EvtLocalAddressesUpdated))
+	if err != nil {
+		return err
+	}
+	if err := writeAddrs(h, path); err != nil {
+		sub.Close()
+		return err
+	}
+	go func() {
+		defer sub.Close()
+		for {
+			select {
+			case <-sub.Out():
+				if err := writeAddrs(h, path); err != nil {
+					log.Printf("listen: %v", err)
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// writeAddrs writes to a temporary file first, so that readers never see
+// half of it
+func writeAddrs(h host.Host, path string) error {
+	as := Addrs{ID: h.ID(), Addrs: []string{}, Full: Full(h)}
+	for _, a := range h.Addrs() {
+		as.Addrs = append(as.Addrs, a.String())
+	}
+	b, err := json.MarshalIndent(as, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".addrs-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(b, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	// CreateTemp makes it 0600, these are for anyone to read
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
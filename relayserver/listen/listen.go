@@ -0,0 +1,209 @@
+// Package listen sets where a relay listens: TCP, QUIC, WebSocket (with
+// TLS, given a certificate) and IPv6 as well as IPv4. Addresses come from
+// repeatable -listen flags, or the "listen" entries of a config file, each
+// a multiaddr or a short form:
+//
+//	tcp:8919    /ip4/0.0.0.0/tcp/8919 and /ip6/::/tcp/8919
+//	quic:8919   the same over UDP, QUIC v1
+//	ws:8080     WebSocket
+//	wss:443     WebSocket over TLS, needs the certificate and its key
+//
+// The short forms listen on IPv4 and IPv6; a host without IPv6 makes do
+// with the IPv4 addresses. What the relay tells others of its addresses can
+// differ from where it listens, see announce.go.
+package listen
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/libp2p/go-libp2p"
+	quic "github.com/libp2p/go-libp2p/p2p/transport/quic"
+	"github.com/libp2p/go-libp2p/p2p/transport/tcp"
+	"github.com/libp2p/go-libp2p/p2p/transport/websocket"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// shorts are the short forms, %d the port
+var shorts = map[string][]string{
+	"tcp":  {"/ip4/0.0.0.0/tcp/%d", "/ip6/::/tcp/%d"},
+	"quic": {"/ip4/0.0.0.0/udp/%d/quic-v1", "/ip6/::/udp/%d/quic-v1"},
+	"ws":   {"/ip4/0.0.0.0/tcp/%d/ws", "/ip6/::/tcp/%d/ws"},
+	"wss":  {"/ip4/0.0.0.0/tcp/%d/wss", "/ip6/::/tcp/%d/wss"},
+}
+
+// Config is where to listen. In a config file:
+//
+//	{"listen": ["tcp:8919", "quic:8919", "wss:443"], "tls_cert": "cert.pem", "tls_key": "key.pem",
+//	 "announce": ["/ip4/203.0.113.7/tcp/8919"], "no_announce": ["private"]}
+type Config struct {
+	Listen     []string `json:"listen"`
+	TLSCert    string   `json:"tls_cert,omitempty"`
+	TLSKey     string   `json:"tls_key,omitempty"`
+	Announce   []string `json:"announce,omitempty"`    // addresses to tell instead
+	NoAnnounce []string `json:"no_announce,omitempty"` // addresses not to tell
+}
+
+// Default listens on TCP and QUIC, at port
+func Default(port int) Config {
+	return Config{Listen: []string{fmt.Sprintf("tcp:%d", port), fmt.Sprintf("quic:%d", port)}}
+}
+
+// Load reads a config file
+func Load(path string) (Config, error) {
+	var c Config
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return c, err
+	}
+	if err := json.Unmarshal(b, &c); err != nil {
+		return c, fmt.Errorf("%s: %v", path, err)
+	}
+	return c, nil
+}
+
+// Addrs are the multiaddrs to listen on, short forms spelled out
+func (c Config) Addrs() ([]ma.Multiaddr, error) {
+	var addrs []ma.Multiaddr
+	for _, s := range c.Listen {
+		spelled := []string{s}
+		if kind, port, ok := strings.Cut(s, ":"); ok && !strings.HasPrefix(s, "/") {
+			forms, known := shorts[kind]
+			n, err := strconv.Atoi(port)
+			if !known || err != nil || n < 0 || n > 65535 {
+				return nil, fmt.Errorf("listen: %q is neither a multiaddr nor one of tcp:, quic:, ws:, wss: and a port", s)
+			}
+			spelled = nil
+			for _, f := range forms {
+				spelled = append(spelled, fmt.Sprintf(f, n))
+			}
+		}
+		for _, s := range spelled {
+			a, err := ma.NewMultiaddr(s)
+			if err != nil {
+				return nil, fmt.Errorf("listen: %q: %v", s, err)
+			}
+			addrs = append(addrs, a)
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, errors.New("listen: nowhere to listen")
+	}
+	return addrs, nil
+}
+
+// Options are the libp2p options for listening as c says
+func (c Config) Options() ([]libp2p.Option, error) {
+	addrs, err := c.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	opts := []libp2p.Option{libp2p.ListenAddrs(addrs...)}
+	factory, err := c.factory()
+	if err != nil {
+		return nil, err
+	}
+	if factory != nil {
+		opts = append(opts, libp2p.AddrsFactory(factory))
+	}
+	secure := false
+	for _, a := range addrs {
+		if _, err := a.ValueForProtocol(ma.P_WSS); err == nil {
+			secure = true
+		}
+		if _, err := a.ValueForProtocol(ma.P_TLS); err == nil {
+			secure = true
+		}
+	}
+	if !secure {
+		return opts, nil // the default transports do
+	}
+	if c.TLSCert == "" || c.TLSKey == "" {
+		return nil, errors.New("listen: wss needs a certificate and its key")
+	}
+	cert, err := tls.LoadX509KeyPair(c.TLSCert, c.TLSKey)
+	if err != nil {
+		return nil, fmt.Errorf("listen: %v", err)
+	}
+	// naming one transport drops the defaults, we name them all
+	return append(opts,
+		libp2p.Transport(tcp.NewTCPTransport),
+		libp2p.Transport(quic.NewTransport),
+		libp2p.Transport(websocket.New, websocket.WithTLSConfig(&tls.Config{Certificates: []tls.Certificate{cert}})),
+	), nil
+}
+
+// Flags are the command line flags for listening
+type Flags struct {
+	listen     []string
+	announce   []string
+	noAnnounce []string
+	file       *string
+	cert       *string
+	key        *string
+	port       *int
+
+	// AddrsFile is where to write the addresses, see WriteAddrs
+	AddrsFile *string
+}
+
+type repeated struct{ to *[]string }
+
+func (r repeated) String() string {
+	if r.to == nil {
+		return ""
+	}
+	return strings.Join(*r.to, ",")
+}
+
+func (r repeated) Set(s string) error {
+	*r.to = append(*r.to, s)
+	return nil
+}
+
+// AddFlags adds the listening flags to fs: -listen, -listen-file, -tls-cert,
+// -tls-key, -announce, -no-announce and -addrs-file. port is where to listen
+// on TCP and QUIC when none are given.
+func AddFlags(fs *flag.FlagSet, port *int) *Flags {
+	fl := &Flags{port: port}
+	fs.Var(repeated{&fl.listen}, "listen", "where to listen, a multiaddr or tcp:, quic:, ws:, wss: and a port; repeat for more")
+	fl.file = fs.String("listen-file", "", `JSON file with "listen" entries, and "tls_cert" and "tls_key" for wss`)
+	fl.cert = fs.String("tls-cert", "", "certificate file for wss")
+	fl.key = fs.String("tls-key", "", "key file of the wss certificate")
+	fs.Var(repeated{&fl.announce}, "announce", "multiaddr to tell clients instead of those we listen on; repeat for more")
+	fs.Var(repeated{&fl.noAnnounce}, "no-announce", "multiaddr, network (10.0.0.0/8) or private, not to tell clients; repeat for more")
+	fl.AddrsFile = fs.String("addrs-file", "", "JSON file to write our addresses to, for clients")
+	return fl
+}
+
+// Config puts the file and the flags together, once they are parsed. The
+// flags add to the file's addresses; with neither, Default is used.
+func (fl *Flags) Config() (Config, error) {
+	var c Config
+	if *fl.file != "" {
+		var err error
+		if c, err = Load(*fl.file); err != nil {
+			return c, err
+		}
+	}
+	c.Listen = append(c.Listen, fl.listen...)
+	c.Announce = append(c.Announce, fl.announce...)
+	c.NoAnnounce = append(c.NoAnnounce, fl.noAnnounce...)
+	if len(c.Listen) == 0 {
+		c.Listen = Default(*fl.port).Listen
+	}
+	if *fl.cert != "" {
+		c.TLSCert = *fl.cert
+	}
+	if *fl.key != "" {
+		c.TLSKey = *fl.key
+	}
+	return c, nil
+}
@@ -0,0 +1,176 @@
+package listen
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+func TestAddrs(t *testing.T) {
+	c := Config{Listen: []string{"tcp:8919", "quic:8919", "ws:8080", "/ip6/::1/tcp/9000"}}
+	addrs, err := c.Addrs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"/ip4/0.0.0.0/tcp/8919", "/ip6/::/tcp/8919",
+		"/ip4/0.0.0.0/udp/8919/quic-v1", "/ip6/::/udp/8919/quic-v1",
+		"/ip4/0.0.0.0/tcp/8080/ws", "/ip6/::/tcp/8080/ws",
+		"/ip6/::1/tcp/9000",
+	}
+	if len(addrs) != len(want) {
+		t.Fatalf("got %v", addrs)
+	}
+	for i, a := range addrs {
+		if a.String() != want[i] {
+			t.Errorf("%d: got %s, want %s", i, a, want[i])
+		}
+	}
+
+	for _, bad := range []string{"udp:8919", "tcp:lots", "tcp:70000", "/ip4/nowhere"} {
+		if _, err := (Config{Listen: []string{bad}}).Addrs(); err == nil {
+			t.Errorf("no error for %q", bad)
+		}
+	}
+	if _, err := (Config{}).Addrs(); err == nil {
+		t.Error("no error with nowhere to listen")
+	}
+}
+
+func TestOptions(t *testing.T) {
+	if _, err := Default(8919).Options(); err != nil {
+		t.Error(err)
+	}
+	if _, err := (Config{Listen: []string{"wss:443"}}).Options(); err == nil {
+		t.Error("wss without a certificate")
+	}
+	c := Config{Listen: []string{"wss:443"}, TLSCert: "missing.pem", TLSKey: "missing.key"}
+	if _, err := c.Options(); err == nil {
+		t.Error("wss with a certificate that is not there")
+	}
+}
+
+func TestFlags(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "listen.json")
+	file := `{"listen": ["tcp:4001"], "tls_cert": "cert.pem", "tls_key": "key.pem"}`
+	if err := os.WriteFile(path, []byte(file), 0600); err != nil {
+		t.Fatal(err)
+	}
+	port := 8919
+	fs := flag.NewFlagSet("relay", flag.ContinueOnError)
+	fl := AddFlags(fs, &port)
+	if err := fs.Parse([]string{"-listen-file", path, "-listen", "quic:4001", "-listen", "ws:8080", "-tls-key", "other.pem", "-no-announce", "private"}); err != nil {
+		t.Fatal(err)
+	}
+	c, err := fl.Config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Listen) != 3 || c.Listen[0] != "tcp:4001" || c.Listen[2] != "ws:8080" {
+		t.Errorf("got %v", c.Listen)
+	}
+	if len(c.NoAnnounce) != 1 || c.NoAnnounce[0] != "private" {
+		t.Errorf("got no-announce %v", c.NoAnnounce)
+	}
+	if c.TLSCert != "cert.pem" || c.TLSKey != "other.pem" {
+		t.Errorf("got cert %s, key %s", c.TLSCert, c.TLSKey)
+	}
+
+	// nothing given, TCP and QUIC on the port
+	fs = flag.NewFlagSet("relay", flag.ContinueOnError)
+	fl = AddFlags(fs, &port)
+	fs.Parse(nil)
+	if c, _ := fl.Config(); len(c.Listen) != 2 || c.Listen[0] != "tcp:8919" || c.Listen[1] != "quic:8919" {
+		t.Errorf("default: got %v", c.Listen)
+	}
+}
+
+func TestAnnounce(t *testing.T) {
+	addrs := func(ss ...string) []ma.Multiaddr {
+		var as []ma.Multiaddr
+		for _, s := range ss {
+			as = append(as, ma.StringCast(s))
+		}
+		return as
+	}
+	listening := addrs("/ip4/192.168.1.5/tcp/8919", "/ip4/127.0.0.1/tcp/8919", "/ip6/::1/tcp/8919", "/ip4/198.51.100.9/tcp/8919")
+
+	for _, tc := range []struct {
+		c    Config
+		want int
+	}{
+		{Config{}, -1}, // no factory
+		{Config{NoAnnounce: []string{"private"}}, 1},
+		{Config{NoAnnounce: []string{"192.168.0.0/16", "/ip6/::1/tcp/8919"}}, 2},
+		{Config{Announce: []string{"/ip4/203.0.113.7/tcp/8919", "/ip4/10.0.0.1/tcp/8919"}}, 2},
+		{Config{Announce: []string{"/ip4/203.0.113.7/tcp/8919", "/ip4/10.0.0.1/tcp/8919"}, NoAnnounce: []string{"10.0.0.0/8"}}, 1},
+	} {
+		f, err := tc.c.factory()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f == nil {
+			if tc.want != -1 {
+				t.Errorf("%+v: no factory", tc.c)
+			}
+			continue
+		}
+		if got := f(listening); len(got) != tc.want {
+			t.Errorf("%+v: got %v", tc.c, got)
+		}
+	}
+
+	for _, c := range []Config{{Announce: []string{"203.0.113.7"}}, {NoAnnounce: []string{"public"}}} {
+		if _, err := c.factory(); err == nil {
+			t.Errorf("%+v: no error", c)
+		}
+	}
+}
+
+func TestWriteAddrs(t *testing.T) {
+	c := Config{Listen: []string{"/ip4/127.0.0.1/tcp/0"}, Announce: []string{"/ip4/203.0.113.7/tcp/8919"}}
+	opts, err := c.Options()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := libp2p.New(opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	path := filepath.Join(t.TempDir(), "addrs.json")
+	if err := WriteAddrs(ctx, h, path); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var as Addrs
+	if err := json.Unmarshal(b, &as); err != nil {
+		t.Fatal(err)
+	}
+	want := "/ip4/203.0.113.7/tcp/8919/p2p/" + h.ID().String()
+	if as.ID != h.ID() || len(as.Full) != 1 || as.Full[0] != want {
+		t.Errorf("got %+v", as)
+	}
+	// clients can read it as they would any peer
+	var ai peer.AddrInfo
+	if err := json.Unmarshal(b, &ai); err != nil {
+		t.Fatal(err)
+	}
+	if ai.ID != h.ID() || len(ai.Addrs) != 1 || ai.Addrs[0].String() != "/ip4/203.0.113.7/tcp/8919" {
+		t.Errorf("as AddrInfo: got %v", ai)
+	}
+}
@@ -4,70 +4,133 @@ import (
 	"context"
 	"crypto/rand"
 	"flag"
-	"fmt"
 	"io"
 	"log"
 	mrand "math/rand"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
+	"github.com/bpc2016/p2p/identity"
+	"github.com/bpc2016/p2p/metrics"
+	"github.com/bpc2016/p2p/relayserver/acl"
+	"github.com/bpc2016/p2p/relayserver/admin"
+	"github.com/bpc2016/p2p/relayserver/limits"
+	"github.com/bpc2016/p2p/relayserver/listen"
 	"github.com/libp2p/go-libp2p"
 	"github.com/libp2p/go-libp2p/core/crypto"
 	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/relay"
-
-	ma "github.com/multiformats/go-multiaddr"
 )
 
-func getHostAddress(ha host.Host) string {
-	// Build host multiaddress
-	hostAddr, _ := ma.NewMultiaddr(fmt.Sprintf("/p2p/%s", ha.ID().String()))
-
-	// Now we can build a full multiaddress to reach this host
-	// by encapsulating both addresses:
-	if len(ha.Addrs()) > 0 {
-		addr := ha.Addrs()[0]
-		return addr.Encapsulate(hostAddr).String()
-	} else {
-		return hostAddr.String()
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "identity" {
+		if err := identity.Command(os.Args[0], os.Args[2:], os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && admin.Commands[os.Args[1]] {
+		if err := admin.Command(os.Args[0], os.Args[1:], os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
 	}
-}
 
-func main() {
-	ctx, cancel := context.WithCancel(context.Background())
+	// ^C or SIGTERM stop the relay
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer cancel()
 
 	// handle flags
-	seedF := flag.Int64("seed", 0, "set random seed for id generation")
-	listenF := flag.Int("l", 8919, "wait for incoming connections")
+	seedF := flag.Int64("seed", 0, "set random seed for id generation (anyone can guess it: use -key)")
+	keyF := flag.String("key", "", "file keeping the relay's identity, created if missing")
+	portF := flag.Int("l", 8919, "port to wait for connections on, TCP and QUIC, unless -listen says otherwise")
+	listenF := listen.AddFlags(flag.CommandLine, portF)
+	limitsF := limits.AddFlags(flag.CommandLine, limits.Default)
+	aclF := flag.String("acl", "", "JSON file of the peers (and networks) allowed to use the relay, reloaded on SIGHUP or change; empty for anyone")
+	adminsF := flag.String("admins", "", "comma separated peer IDs that may use the admin protocol: status, kick, ban")
+	metricsF := flag.String("metrics", "", "address to serve Prometheus metrics on, at /metrics, such as :9100; empty for none")
 	flag.Parse()
+	rc, err := limitsF.Resources()
+	if err != nil {
+		log.Fatal(err)
+	}
+	lc, err := listenF.Config()
+	if err != nil {
+		log.Fatal(err)
+	}
+	listenOpts, err := lc.Options()
+	if err != nil {
+		log.Fatal(err)
+	}
+	var admins []peer.ID
+	for _, s := range strings.Split(*adminsF, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		p, err := peer.Decode(s)
+		if err != nil {
+			log.Fatalf("-admins: %v", err)
+		}
+		admins = append(admins, p)
+	}
 
-	// setup the relay host - with  nonzero seed will haave a fixed address
-	var r io.Reader
-	if *seedF == 0 {
-		r = rand.Reader
+	// setup the relay host - a key file, or a nonzero seed, gives a fixed address
+	var priv crypto.PrivKey
+	if *keyF != "" {
+		if priv, _, err = identity.LoadOrCreate(*keyF, identity.Passphrase()); err != nil {
+			log.Printf("Failed to load key: %v", err)
+			return
+		}
 	} else {
-		r = mrand.New(mrand.NewSource(*seedF))
-	}
+		var r io.Reader
+		if *seedF == 0 {
+			r = rand.Reader
+		} else {
+			r = mrand.New(mrand.NewSource(*seedF))
+		}
 
-	// Generate a key pair for this host. We will use it at least
-	// to obtain a valid host ID.
-	priv, _, err := crypto.GenerateKeyPairWithReader(crypto.RSA, 2048, r)
-	if err != nil {
-		log.Printf("Failed to generate key pair: %v", err)
-		return
+		// Generate a key pair for this host. We will use it at least
+		// to obtain a valid host ID.
+		priv, _, err = crypto.GenerateKeyPairWithReader(crypto.RSA, 2048, r)
+		if err != nil {
+			log.Printf("Failed to generate key pair: %v", err)
+			return
+		}
 	}
-	// Create a host to act as a middleman to relay messages on our behalf
-	relayHost, err := libp2p.New(
-		libp2p.ListenAddrStrings(fmt.Sprintf("/ip4/0.0.0.0/tcp/%d", *listenF)),
+
+	// Create a host to act as a middleman to relay messages on our behalf,
+	// counting the bytes for -metrics and the admins
+	bw := admin.NewTraffic()
+	relayHost, err := libp2p.New(append(listenOpts,
 		libp2p.Identity(priv),
-	)
+		libp2p.BandwidthReporter(bw),
+	)...)
 	if err != nil {
 		log.Printf("Failed to create relayHost: %v", err)
 		return
 	}
 
-	fullAddr := getHostAddress(relayHost)
-	log.Printf("Relay is: %s\nUse this address in setting up relay services", fullAddr)
+	// every address clients can reach us at, as we tell them
+	full := listen.Full(relayHost)
+	for _, addr := range full {
+		log.Printf("Reachable at %s", addr)
+	}
+	if len(full) == 0 {
+		log.Printf("No address to give clients, see -announce and -no-announce")
+		full = append(full, "/p2p/"+relayHost.ID().String())
+	}
+	if *listenF.AddrsFile != "" {
+		if err := listen.WriteAddrs(ctx, relayHost, *listenF.AddrsFile); err != nil {
+			log.Printf("Failed to write the addresses: %v", err)
+			return
+		}
+		log.Printf("Addresses written to %s", *listenF.AddrsFile)
+	}
+	log.Printf("Relay is: %s\nUse this address, or any above, in setting up relay services", full[0])
 
 	// Configure the host to offer the ciruit relay service.
 	// Any host that is directly dialable in the network (or on the internet)
@@ -75,23 +138,96 @@ func main() {
 	// "dedicated" relay services.
 	// In circuit relay v2 (which we're using here!) it is rate limited so that
 	// any node can offer this service safely
-	// do so with an option that keeps the stream alive indefinitely
-	_, err = relay.New(relayHost, relay.WithInfiniteLimits())
+	// here with the limits we were given, -limits demo keeps the streams
+	// alive indefinitely
+	log.Printf("Relay limits: %s", limits.String(rc))
+	opts := []relay.Option{relay.WithResources(rc)}
+	var allow relay.ACLFilter
+	var list *acl.ACL
+	if *aclF != "" {
+		list, err = acl.Load(*aclF)
+		if err != nil {
+			log.Printf("Failed to load the ACL: %v", err)
+			return
+		}
+		log.Printf("ACL: %s", list)
+		go list.Watch(ctx)
+		allow = list
+	}
+	var adm *admin.Server
+	if len(admins) > 0 {
+		adm = admin.NewServer(relayHost, bw, rc.ReservationTTL, admins, allow)
+		defer adm.Close()
+		allow = adm
+		log.Printf("Admin protocol open to %v", admins)
+	}
+	var stats *metrics.Relay
+	if *metricsF != "" {
+		stats = metrics.NewRelay(relayHost, bw.BandwidthCounter, allow)
+		allow = stats
+		// refusals are counted where they happen
+		if list != nil {
+			list.Refused = stats.Refused("acl")
+		}
+		if adm != nil {
+			adm.Refused = stats.Refused("ban")
+		}
+	}
+	if allow != nil {
+		opts = append(opts, relay.WithACL(allow))
+	}
+	rly, err := relay.New(relayHost, opts...)
 	if err != nil {
 		log.Printf("Failed to instantiate the relay: %v", err)
 		return
 	}
+	if stats != nil {
+		srv, err := metrics.Serve(*metricsF, stats)
+		if err != nil {
+			log.Printf("Failed to serve metrics: %v", err)
+			return
+		}
+		defer srv.Close()
+		log.Printf("Metrics at http://%s/metrics", *metricsF)
+	}
 
 	// we want to keep looking at attached hosts
 	go func() {
+		ticker := time.NewTicker(1 * time.Minute)
+		defer ticker.Stop()
 		for {
-			time.Sleep(1 * time.Minute)
-			// fetch the mas of connected peers
-			ids := relayHost.Network().Peers()
-			log.Printf("ids: %v\n", ids)
+			select {
+			case <-ticker.C:
+				// fetch the mas of connected peers
+				ids := relayHost.Network().Peers()
+				log.Printf("ids: %v\n", ids)
+			case <-ctx.Done():
+				return
+			}
 		}
 	}()
 
 	// Run until canceled.
 	<-ctx.Done()
+	cancel() // a second ^C kills us
+	log.Println("Relay closing")
+	shutdown(relayHost, rly)
+}
+
+// shutdownTimeout bounds how long closing down may take
+const shutdownTimeout = 5 * time.Second
+
+// shutdown drops the reservations and circuits, then the host
+func shutdown(h host.Host, rly *relay.Relay) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		rly.Close()
+		h.Close()
+	}()
+	select {
+	case <-done:
+	case <-time.After(shutdownTimeout):
+		log.Println("gave up waiting for the host to close")
+	}
 }